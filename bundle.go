@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// bundleSource reads files from a single zip, tar or gzipped tar file
+// holding the package directory, fetched from uri on first use unless
+// data is set. The bundle is indexed once; zip entries stay compressed
+// until read, and archives are only decoded when a compile needs them.
+// A failure to fetch the bundle is not remembered.
+type bundleSource struct {
+	uri  string
+	data []byte
+
+	mu    sync.Mutex // held while indexing
+	files map[string]func() ([]byte, error)
+	err   error
+}
+
+var (
+	zipMagic  = []byte("PK\x03\x04")
+	gzipMagic = []byte("\x1f\x8b")
+)
+
+// index indexes the bundle unless it has been.
+func (s *bundleSource) index() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files != nil || s.err != nil {
+		return s.err
+	}
+	if s.data == nil {
+		b, err := get(s.uri)
+		if err != nil {
+			return err
+		}
+		s.data = b
+	}
+	switch {
+	case bytes.HasPrefix(s.data, zipMagic):
+		s.err = s.indexZip()
+	case bytes.HasPrefix(s.data, gzipMagic):
+		r, err := gzip.NewReader(bytes.NewReader(s.data))
+		if err == nil {
+			err = s.indexTar(r)
+		}
+		s.err = err
+		s.data = nil
+	default:
+		s.err = s.indexTar(bytes.NewReader(s.data))
+		s.data = nil
+	}
+	if s.err != nil {
+		s.files = nil
+		s.err = &corruptBundleError{uri: s.uri, err: s.err}
+	}
+	return s.err
+}
+
+func (s *bundleSource) indexZip() error {
+	r, err := zip.NewReader(bytes.NewReader(s.data), int64(len(s.data)))
+	if err != nil {
+		return err
+	}
+	s.files = make(map[string]func() ([]byte, error), len(r.File))
+	for _, f := range r.File {
+		f := f
+		s.add(f.Name, func() ([]byte, error) {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return ioutil.ReadAll(rc)
+		})
+	}
+	return nil
+}
+
+func (s *bundleSource) indexTar(r io.Reader) error {
+	s.files = make(map[string]func() ([]byte, error))
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		s.add(h.Name, func() ([]byte, error) { return b, nil })
+	}
+}
+
+// add indexes a file of the bundle by its name in the package directory,
+// which the bundle may hold at its root or as pkg.
+func (s *bundleSource) add(name string, read func() ([]byte, error)) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	name = strings.TrimPrefix(name, "pkg/")
+	s.files[name] = read
+}
+
+func (s *bundleSource) ReadFile(name string) ([]byte, error) {
+	if err := s.index(); err != nil {
+		return nil, err
+	}
+	read, ok := s.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: s.uri + ":" + name, Err: os.ErrNotExist}
+	}
+	return read()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"testing"
+)
+
+var bundleFiles = map[string]string{
+	"fmt.a":                 "fmt archive",
+	"example.com/m/pkg.a":   "nested archive",
+	"imports.json":          "{}",
+	"example.com/m/pkg/p.a": "package named pkg",
+}
+
+func zipBundle(t *testing.T, prefix string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range bundleFiles {
+		f, err := w.Create(prefix + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarBundle(t *testing.T, prefix string) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	w.WriteHeader(&tar.Header{Name: prefix, Typeflag: tar.TypeDir, Mode: 0755})
+	for name, data := range bundleFiles {
+		if err := w.WriteHeader(&tar.Header{Name: prefix + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tgzBundle(t *testing.T, prefix string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(tarBundle(t, prefix))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBundleSource(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		bundle func(*testing.T, string) []byte
+		prefix string
+	}{
+		{"zip", zipBundle, ""},
+		{"zip in pkg", zipBundle, "pkg/"},
+		{"tar", tarBundle, ""},
+		{"tar in ./pkg", tarBundle, "./pkg/"},
+		{"tgz", tgzBundle, ""},
+		{"tgz in pkg", tgzBundle, "pkg/"},
+	} {
+		s := &bundleSource{uri: test.name, data: test.bundle(t, test.prefix)}
+		for name, want := range bundleFiles {
+			b, err := s.ReadFile(name)
+			if err != nil {
+				t.Errorf("%s: %s: %v", test.name, name, err)
+				continue
+			}
+			if string(b) != want {
+				t.Errorf("%s: %s is %q, want %q", test.name, name, b, want)
+			}
+		}
+		if _, err := s.ReadFile("os.a"); !os.IsNotExist(err) {
+			t.Errorf("%s: reading a missing file: got %v, want not exist", test.name, err)
+		}
+	}
+}
+
+func TestBundleSourceCorrupt(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"zip": []byte("PK\x03\x04 not a zip"),
+		"tgz": []byte("\x1f\x8b not gzip"),
+	} {
+		s := &bundleSource{uri: name, data: data}
+		_, err := s.ReadFile("fmt.a")
+		if _, ok := err.(*corruptBundleError); !ok {
+			t.Errorf("%s: got %v, want a corrupt bundle", name, err)
+		}
+		if transient(err) {
+			t.Errorf("%s: %v is transient", name, err)
+		}
+		if _, again := s.ReadFile("fmt.a"); again != err {
+			t.Errorf("%s: the failure was not remembered: %v", name, again)
+		}
+	}
+}
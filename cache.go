@@ -0,0 +1,448 @@
+// +build js
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/types"
+	"strings"
+	"sync"
+
+	"github.com/gopherjs/gopherjs/compiler"
+	"github.com/gopherjs/gopherjs/js"
+	"github.com/j7b/jsplayground/important"
+)
+
+// packageCache holds the archives shared by all compiles. Each archive
+// is fetched once; gets of a path that is being fetched wait for the
+// fetch in flight, unless the fetch waits for the package compiled from
+// the module proxy that imports it, which is an import cycle. Reads that
+// fail for transient reasons are retried with backoff, and are not
+// remembered, so the next get tries again.
+//
+// Decoding an archive adds its types to packages, which the type checker
+// reads, so archives are decoded and type checked holding check.
+type packageCache struct {
+	check      sync.Mutex
+	manifestMu sync.Mutex // held while reading the manifest
+	importsMu  sync.Mutex // held while reading imports.json
+
+	mu          sync.Mutex // guards the fields below
+	archives    map[string]*compiler.Archive
+	errs        map[string]error
+	pending     map[string]*loading
+	waits       map[string]map[string]int // loads the compile of a package waits for, by path
+	source      PackageSource
+	gen         int // incremented by reset
+	importsGen  int // the gen imports.json was read for
+	manifest    *manifest
+	manifestErr error        // of parsing manifest
+	manifestGen int          // the gen manifest was read for
+	proxy       *moduleProxy // of packages without archives, if any
+
+	packages map[string]*types.Package
+	// compiled holds the module versions of the archives compiled from
+	// the module proxy, by path.
+	compiled map[string]string
+	// local holds the archives of the local packages of earlier
+	// requests, by path. They are not in archives, and their types not
+	// in packages: each request adds those of its own to copies.
+	local    map[string]*localArchive
+	versions versions      // of the modules, as the last pin set them
+	pins     int           // incremented by pin when it changes versions
+	users    int           // compiles between pin and unpin
+	unpinned chan struct{} // closed when users drops to 0
+}
+
+func newPackageCache(source PackageSource) *packageCache {
+	c := &packageCache{waits: make(map[string]map[string]int)}
+	c.reset(source)
+	return c
+}
+
+// reset empties c and makes it read archives from source. Archives
+// already loaded may differ from those source has, and the types they
+// added cannot be removed from packages, so everything is dropped.
+func (c *packageCache) reset(source PackageSource) {
+	c.check.Lock()
+	defer c.check.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.archives = make(map[string]*compiler.Archive)
+	c.errs = make(map[string]error)
+	c.pending = make(map[string]*loading)
+	c.source = source
+	c.gen++
+	c.packages = make(map[string]*types.Package)
+	c.compiled = make(map[string]string)
+	c.local = make(map[string]*localArchive)
+}
+
+// lookup returns the archive for path if it has been loaded.
+func (c *packageCache) lookup(path string) (*compiler.Archive, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if a, ok := c.archives[path]; ok {
+		return a, nil
+	}
+	if err, ok := c.errs[path]; ok {
+		return nil, err
+	}
+	return nil, fmt.Errorf("package %s not loaded", path)
+}
+
+// loading is an archive being fetched.
+type loading struct {
+	done    chan struct{}
+	gen     int // of the source it is fetched from
+	pins    int // of the versions it is fetched at
+	archive *compiler.Archive
+	size    int // bytes read from the source
+	err     error
+}
+
+// changed returns an error if l, the load of path, may not be kept
+// because the source, or for a package of a module the versions, have
+// changed since it began.
+func (c *packageCache) changed(path string, l *loading) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.gen != l.gen:
+		return fmt.Errorf("package source changed while loading %s", path)
+	case c.pins != l.pins && inModule(path):
+		return fmt.Errorf("module versions changed while loading %s", path)
+	}
+	return nil
+}
+
+// get returns the archive for path, fetching and decoding it if needed,
+// and the number of bytes read from the source for it, which is 0 if it
+// was already loaded. from is the package compiled from the module proxy
+// that imports path, if any; get fails if the load of path waits for
+// that of from. The caller must not hold check.
+func (c *packageCache) get(path, from string) (*compiler.Archive, int, error) {
+	c.mu.Lock()
+	if a, ok := c.archives[path]; ok {
+		c.mu.Unlock()
+		return a, 0, nil
+	}
+	if err, ok := c.errs[path]; ok {
+		c.mu.Unlock()
+		return nil, 0, err
+	}
+	if from != "" {
+		if cycle := importCycle(c.waits, from, path); cycle != nil {
+			c.mu.Unlock()
+			return nil, 0, fmt.Errorf("import cycle not allowed: %s", strings.Join(cycle, " -> "))
+		}
+		c.wait(from, path, 1)
+		defer func() {
+			c.mu.Lock()
+			c.wait(from, path, -1)
+			c.mu.Unlock()
+		}()
+	}
+	// A load of a package of a module begun at other versions is not
+	// kept, so it is not waited for.
+	if l, ok := c.pending[path]; ok && (l.pins == c.pins || !inModule(path)) {
+		c.mu.Unlock()
+		<-l.done
+		return l.archive, l.size, l.err
+	}
+	l := &loading{done: make(chan struct{}), gen: c.gen, pins: c.pins}
+	c.pending[path] = l
+	source, proxy, v := c.source, c.proxy, c.versions
+	c.mu.Unlock()
+
+	b, retry, err := c.read(source, l.gen, path, v)
+	l.size = len(b)
+	var src *moduleSources
+	switch err.(type) {
+	case *notFoundError, *versionConflictError:
+		if proxy != nil && inModule(path) {
+			src, l.size, retry, err = c.moduleSources(proxy, path, v, err)
+		}
+	}
+	// The archive is decoded, or compiled, and kept holding check, so
+	// that a pin changing versions, which holds it, either comes before
+	// and the load is not kept, or after and sees the archive.
+	c.check.Lock()
+	stale := c.changed(path, l)
+	fresh := false
+	switch {
+	case stale != nil:
+		err, retry = stale, true
+	case err == nil && src != nil:
+		l.archive, fresh, err = c.compileModule(src)
+	case err == nil:
+		l.archive, err = compiler.ReadArchive(path+".a", path, bytes.NewReader(b), c.packages)
+		if err != nil {
+			err = decodeError(path, err)
+		}
+	}
+	l.err = err
+	c.mu.Lock()
+	switch {
+	case stale != nil:
+		// Neither kept nor remembered.
+	case err == nil:
+		c.archives[path] = l.archive
+		if src != nil {
+			c.compiled[path] = src.mv.String()
+		}
+	case !retry:
+		c.errs[path] = err
+	}
+	if c.pending[path] == l {
+		delete(c.pending, path)
+	}
+	c.mu.Unlock()
+	c.check.Unlock()
+	close(l.done)
+	if fresh {
+		src.keep(l.archive)
+	}
+	return l.archive, l.size, l.err
+}
+
+// wait adds n to the loads of path the compile of from waits for. The
+// caller holds mu.
+func (c *packageCache) wait(from, path string, n int) {
+	if c.waits[from] == nil {
+		c.waits[from] = make(map[string]int)
+	}
+	if c.waits[from][path] += n; c.waits[from][path] == 0 {
+		delete(c.waits[from], path)
+		if len(c.waits[from]) == 0 {
+			delete(c.waits, from)
+		}
+	}
+}
+
+// read returns the archive of path from source, verified against the
+// manifest of source and the versions v pins modules to. retry is set
+// if the failure is transient.
+func (c *packageCache) read(source PackageSource, gen int, path string, v versions) (b []byte, retry bool, err error) {
+	m, err := c.loadManifest(source, gen)
+	if corrupt(err) {
+		return nil, false, err
+	}
+	if err != nil {
+		return nil, transient(err), &networkError{path: path, err: err}
+	}
+	if err := m.check(path); err != nil {
+		return nil, false, err
+	}
+	if err := m.checkVersion(path, v); err != nil {
+		return nil, false, err
+	}
+	b, err = readFile(source, path+".a")
+	if err != nil {
+		return nil, transient(err), readError(path, err)
+	}
+	if err := m.verify(path, b); err != nil {
+		return nil, false, err
+	}
+	return b, false, nil
+}
+
+// loadManifest returns the manifest of source, the source of generation
+// gen, reading it on first use. A failure to read it is not remembered,
+// unless the manifest, or the bundle holding it, cannot be parsed.
+func (c *packageCache) loadManifest(source PackageSource, gen int) (*manifest, error) {
+	c.manifestMu.Lock()
+	defer c.manifestMu.Unlock()
+	c.mu.Lock()
+	m, err, ok := c.manifest, c.manifestErr, c.manifestGen == gen
+	c.mu.Unlock()
+	if ok {
+		return m, err
+	}
+	m, err = readManifest(source)
+	if err != nil && !corrupt(err) {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.gen == gen {
+		c.manifest, c.manifestErr, c.manifestGen = m, err, gen
+	}
+	c.mu.Unlock()
+	return m, err
+}
+
+// setProxy makes c compile packages there are no archives for from the
+// sources of proxy, or not if proxy is nil. Failures to load are
+// forgotten.
+func (c *packageCache) setProxy(proxy *moduleProxy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.proxy = proxy
+	c.errs = make(map[string]error)
+}
+
+// pin makes packages of modules be compiled at the versions of v, and
+// those of modules v does not have at their latest version, until unpin.
+// Compiles pinning the same versions run at the same time; one pinning
+// others waits until they have unpinned, or canceled is closed, when it
+// returns errCanceled. Changing versions drops the archives compiled at
+// others and failures to load; loads begun before are not kept. pin
+// fails, unpinning, if archives read from the source at other versions
+// have been loaded.
+func (c *packageCache) pin(v versions, canceled <-chan struct{}) error {
+	latest := c.latest(v)
+	for {
+		c.mu.Lock()
+		ok, unpinned := c.users == 0 || c.versions.equal(v), c.unpinned
+		c.mu.Unlock()
+		if !ok {
+			select {
+			case <-unpinned:
+			case <-canceled:
+				return errCanceled
+			}
+			continue
+		}
+		c.check.Lock()
+		c.mu.Lock()
+		if c.users == 0 || c.versions.equal(v) {
+			break
+		}
+		c.mu.Unlock()
+		c.check.Unlock()
+	}
+	defer c.check.Unlock()
+	if c.users == 0 {
+		c.unpinned = make(chan struct{})
+	}
+	c.users++
+	old, m := c.versions, c.manifest
+	changed := !old.equal(v)
+	if changed {
+		c.versions = v
+		c.pins++
+		c.errs = make(map[string]error)
+	}
+	var stale []string
+	var conflicts versionConflicts
+	for path := range c.archives {
+		src, ok := c.compiled[path]
+		_, _, was := old.lookup(path)
+		_, mv, is := v.lookup(path)
+		switch {
+		case !ok:
+			if err := m.checkVersion(path, v); err != nil {
+				conflicts = append(conflicts, err.(*versionConflictError))
+			}
+		case is && src != mv.String(), was && !is && src != latest[path]:
+			stale = append(stale, path)
+		}
+	}
+	c.mu.Unlock()
+	for _, path := range stale {
+		c.dropCompiled(path)
+	}
+	if len(conflicts) > 0 {
+		c.unpin()
+		return conflicts
+	}
+	return nil
+}
+
+// unpin ends a compile's use of the versions it pinned.
+func (c *packageCache) unpin() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.users--; c.users == 0 {
+		close(c.unpinned)
+	}
+}
+
+// latest returns, by path, the latest versions of the modules of the
+// archives compiled at the versions the last pin set that v does not
+// have, so pin keeps those that are compiled at the latest version.
+func (c *packageCache) latest(v versions) map[string]string {
+	c.mu.Lock()
+	proxy, old := c.proxy, c.versions
+	var paths []string
+	for path := range c.compiled {
+		_, _, was := old.lookup(path)
+		_, _, is := v.lookup(path)
+		if was && !is {
+			paths = append(paths, path)
+		}
+	}
+	c.mu.Unlock()
+	latest := make(map[string]string)
+	if proxy == nil {
+		return latest
+	}
+	for _, path := range paths {
+		if _, mv, err := proxy.module(path, nil); err == nil {
+			latest[path] = mv.String()
+		}
+	}
+	return latest
+}
+
+// moduleProxy returns the module proxy of c, or nil if there is none.
+func (c *packageCache) moduleProxy() *moduleProxy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.proxy
+}
+
+// forget drops the failure to load path, so the next get tries again,
+// or all archives and failures if path is "". Copies of files the
+// source keeps are dropped too.
+func (c *packageCache) forget(path string) {
+	c.mu.Lock()
+	source := c.source
+	c.mu.Unlock()
+	if f, ok := source.(forgetter); ok {
+		name := ""
+		if path != "" {
+			name = path + ".a"
+		}
+		f.forget(name)
+	}
+	if path == "" {
+		if storage := cacheStorage(); storage != nil {
+			await(storage.Call("delete", moduleCache))
+		}
+		c.reset(source)
+		return
+	}
+	c.mu.Lock()
+	delete(c.errs, path)
+	c.mu.Unlock()
+}
+
+// loadImports adds the symbols of the source's imports.json to those the
+// import fixer knows, once per source. A failure to read it that is
+// transient is not remembered, so the next call tries again.
+func (c *packageCache) loadImports() {
+	c.importsMu.Lock()
+	defer c.importsMu.Unlock()
+	c.mu.Lock()
+	source, gen, done := c.source, c.gen, c.importsGen == c.gen
+	c.mu.Unlock()
+	if done {
+		return
+	}
+	b, err := readFile(source, "imports.json")
+	retry := err != nil && transient(err)
+	if err == nil {
+		err = important.ReadImports(bytes.NewReader(b))
+	}
+	if err != nil {
+		js.Global.Get("console").Call("warn", "additional imports: "+err.Error())
+	}
+	if retry {
+		return
+	}
+	c.mu.Lock()
+	c.importsGen = gen
+	c.mu.Unlock()
+}
@@ -0,0 +1,54 @@
+// +build js
+
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// errCanceled is returned by stages of a request stopped by its
+// cancellation.
+var errCanceled = errors.New("canceled")
+
+// cancellation is the cancellation of a request, which its stages check
+// between them.
+type cancellation struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func newCancellation() *cancellation {
+	return &cancellation{done: make(chan struct{})}
+}
+
+func (c *cancellation) cancel() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// canceled reports whether the request has been cancelled.
+func (c *cancellation) canceled() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// bind gives p, the promise of the request, a cancel method, and cancels
+// the request when signal, an AbortSignal, aborts.
+func (c *cancellation) bind(p, signal *js.Object) *js.Object {
+	p.Set("cancel", c.cancel)
+	if signal == nil || signal == js.Undefined {
+		return p
+	}
+	if signal.Get("aborted").Bool() {
+		c.cancel()
+		return p
+	}
+	signal.Call("addEventListener", "abort", c.cancel)
+	return p
+}
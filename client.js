@@ -0,0 +1,187 @@
+// GoWorker runs jsplayground.js in a Web Worker, so compiling does not
+// block the page, and provides the API of Go over the protocol described
+// in worker.go:
+//
+//     var Go = new GoWorker("jsplayground.js");
+//     Go.Compile(source).then(function(result) { ... });
+//
+// Methods return Promises, those of methods of Go that return them
+// settling the same way, with a cancel method that rejects them with a
+// "canceled" diagnostic. RedirectConsole and
+// SyncImport are not available; run programs with Run. Relative URIs are
+// resolved against the page.
+(function(global) {
+  "use strict";
+
+  var protocolVersion = 1;
+
+  var GoWorker = function(uri) {
+    var worker = new Worker(uri);
+    var pending = {};
+    var listeners = {};
+    var nextID = 1;
+    var progressID = 0;
+
+    worker.addEventListener("message", function(e) {
+      var m = e.data;
+      if (!m || m.jsplayground !== protocolVersion) {
+        return;
+      }
+      if (m.event !== undefined) {
+        var f = (listeners[m.id] || {})[m.event];
+        if (f) {
+          f.apply(null, m.args);
+        }
+        return;
+      }
+      var p = pending[m.id];
+      if (!p) {
+        return;
+      }
+      delete pending[m.id];
+      if (m.id !== progressID) {
+        delete listeners[m.id];
+      }
+      if ("error" in m) {
+        p.reject(typeof m.error === "string" ? new Error(m.error) : m.error);
+        return;
+      }
+      p.resolve(m.result);
+    });
+
+    // call posts a request. Functions in args, or in objects in args,
+    // are sent as true, named in the request's callbacks, and called when
+    // the worker posts their events.
+    // An AbortSignal in an object, as signal, is not sent; it cancels the
+    // request.
+    var call = function(method, args) {
+      var id = nextID++;
+      var callbacks = {};
+      var signal = null;
+      args = args.map(function(arg) {
+        if (typeof arg === "function") {
+          // Only Preload and OnProgress take functions as arguments.
+          callbacks.onProgress = arg;
+          return true;
+        }
+        if (arg && typeof arg === "object" && Object.getPrototypeOf(arg) === Object.prototype) {
+          var o = {};
+          Object.keys(arg).forEach(function(key) {
+            if (key === "signal") {
+              signal = arg[key];
+              return;
+            }
+            if (typeof arg[key] === "function") {
+              callbacks[key] = arg[key];
+              o[key] = true;
+              return;
+            }
+            o[key] = arg[key];
+          });
+          return o;
+        }
+        return arg;
+      });
+      listeners[id] = callbacks;
+      var names = Object.keys(callbacks);
+      var promise = new Promise(function(resolve, reject) {
+        pending[id] = {resolve: resolve, reject: reject};
+      });
+      promise.cancel = function() {
+        if (pending[id]) {
+          worker.postMessage({jsplayground: protocolVersion, id: nextID++, method: "cancel", args: [id]});
+        }
+      };
+      promise.id = id;
+      worker.postMessage({jsplayground: protocolVersion, id: id, method: method, args: args, callbacks: names});
+      if (signal) {
+        if (signal.aborted) {
+          promise.cancel();
+        } else {
+          signal.addEventListener("abort", promise.cancel);
+        }
+      }
+      return promise;
+    };
+
+    var resolve = function(uri) {
+      return String(new URL(uri, global.location.href));
+    };
+
+    // resolveSpec returns a copy of a package source spec with its uri,
+    // and those of the specs in it, resolved.
+    var resolveSpec = function(spec) {
+      if (!spec || typeof spec !== "object") {
+        return spec;
+      }
+      var o = {};
+      Object.keys(spec).forEach(function(key) {
+        o[key] = spec[key];
+      });
+      if (typeof o.uri === "string") {
+        o.uri = resolve(o.uri);
+      }
+      if (o.source) {
+        o.source = resolveSpec(o.source);
+      }
+      if (Array.isArray(o.sources)) {
+        o.sources = o.sources.map(resolveSpec);
+      }
+      return o;
+    };
+
+    this.Compile = function(source, options) {
+      return call("compile", [source, options]);
+    };
+    this.CompileFiles = function(files, options) {
+      return call("compileFiles", [files, options]);
+    };
+    this.Run = function(source, options) {
+      var stdin = options && options.stdin;
+      if (typeof stdin === "function" || (stdin && typeof stdin.getReader === "function")) {
+        return Promise.reject(new Error("input read as the program runs is not available in a worker"));
+      }
+      return call("run", [source, options]);
+    };
+    this.Format = function(source, imports, options) {
+      return call("format", [source, !!imports, options]);
+    };
+    this.FixImports = function(source, options) {
+      return call("fixImports", [source, options]);
+    };
+    this.Preload = function(paths, onProgress) {
+      return call("preload", [paths, onProgress]);
+    };
+    this.OnProgress = function(f) {
+      delete listeners[progressID];
+      var promise = call("onProgress", [f || false]);
+      progressID = promise.id;
+      return promise;
+    };
+    this.PackageURI = function() {
+      var uris = [];
+      Array.prototype.forEach.call(arguments, function(uri) {
+        uris = uris.concat(uri);
+      });
+      return call("packageURI", uris.map(resolve));
+    };
+    this.PackageSource = function(source) {
+      return call("packageSource", [resolveSpec(source)]);
+    };
+    this.ModuleProxy = function(spec) {
+      if (spec === undefined) {
+        spec = null;
+      }
+      return call("moduleProxy", [typeof spec === "string" && spec !== "" ? resolve(spec) : resolveSpec(spec)]);
+    };
+    this.ClearCache = function(path) {
+      return call("clearCache", path === undefined ? [] : [path]);
+    };
+    // Terminate stops the worker. Requests not yet answered never are.
+    this.Terminate = function() {
+      worker.terminate();
+    };
+  };
+
+  global.GoWorker = GoWorker;
+})(this);
@@ -0,0 +1,187 @@
+// +build js
+
+package main
+
+import (
+	"go/scanner"
+	"go/token"
+	"go/types"
+
+	"github.com/gopherjs/gopherjs/compiler"
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// Severities.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// Diagnostic codes, one per pipeline stage.
+const (
+	codeSyntax   = "syntax"
+	codeType     = "type"
+	codeImport   = "import"
+	codeLink     = "link"
+	codeRun      = "run"
+	codeInternal = "internal"
+	codeCanceled = "canceled"
+
+	// Failures to load imports.
+	codeNotFound        = "not-found"
+	codeCorruptArchive  = "corrupt-archive"
+	codeVersionMismatch = "version-mismatch"
+	codeNetwork         = "network"
+
+	// Versions of a module that cannot all be used.
+	codeVersionConflict = "version-conflict"
+)
+
+// diagnostic is a positioned message reported to Javascript. Positions
+// are 1-based; a zero Line means the message has no position.
+type diagnostic struct {
+	File      string
+	Line      int
+	Column    int
+	EndLine   int
+	EndColumn int
+	Severity  string
+	Code      string
+	Message   string
+}
+
+func (d diagnostic) object() js.M {
+	return js.M{
+		"file":      d.File,
+		"line":      d.Line,
+		"column":    d.Column,
+		"endLine":   d.EndLine,
+		"endColumn": d.EndColumn,
+		"severity":  d.Severity,
+		"code":      d.Code,
+		"message":   d.Message,
+	}
+}
+
+// objects converts list for resolving or rejecting a promise.
+func objects(list []diagnostic) []js.M {
+	objs := make([]js.M, len(list))
+	for i, d := range list {
+		objs[i] = d.object()
+	}
+	return objs
+}
+
+// diagnose converts err to diagnostics. Errors without a more specific
+// code get code. sources maps file names to their contents and is used
+// to find the end of the offending token.
+func diagnose(err error, code string, sources map[string][]byte) []diagnostic {
+	switch t := err.(type) {
+	case scanner.ErrorList:
+		list := make([]diagnostic, 0, len(t))
+		for _, e := range t {
+			list = append(list, positioned(e.Pos, codeSyntax, e.Msg, sources))
+		}
+		return list
+	case *scanner.Error:
+		return []diagnostic{positioned(t.Pos, codeSyntax, t.Msg, sources)}
+	case compiler.ErrorList:
+		var list []diagnostic
+		for _, e := range t {
+			list = append(list, diagnose(e, codeType, sources)...)
+		}
+		return list
+	case types.Error:
+		return []diagnostic{positioned(t.Fset.Position(t.Pos), codeType, t.Msg, sources)}
+	case versionConflicts:
+		var list []diagnostic
+		for _, e := range t {
+			list = append(list, diagnose(e, code, sources)...)
+		}
+		return list
+	case *versionConflictError:
+		if line := t.requirement(sources["go.mod"]); line > 0 {
+			return []diagnostic{positioned(linePosition("go.mod", sources["go.mod"], line), codeVersionConflict, t.msg, sources)}
+		}
+	case *importChainError:
+		// A version conflict is positioned at the requirement, not at
+		// the import.
+		if e, ok := t.err.(*versionConflictError); ok {
+			if line := e.requirement(sources["go.mod"]); line > 0 {
+				return []diagnostic{positioned(linePosition("go.mod", sources["go.mod"], line), codeVersionConflict, t.Error(), sources)}
+			}
+		}
+	}
+	return []diagnostic{{Severity: severityError, Code: codeOf(err, code), Message: err.Error()}}
+}
+
+// canceled is the diagnostic of a request canceled before it completed.
+func canceled() diagnostic {
+	return diagnostic{Severity: severityError, Code: codeCanceled, Message: "canceled"}
+}
+
+// codeOf returns the code for err, or code if err is not a failure to
+// load an import.
+func codeOf(err error, code string) string {
+	if e, ok := err.(*importChainError); ok {
+		err = e.err
+	}
+	switch err.(type) {
+	case *notFoundError:
+		return codeNotFound
+	case *corruptArchiveError, *corruptManifestError, *corruptBundleError:
+		return codeCorruptArchive
+	case *versionMismatchError:
+		return codeVersionMismatch
+	case *versionConflictError:
+		return codeVersionConflict
+	case *networkError:
+		return codeNetwork
+	}
+	return code
+}
+
+func positioned(pos token.Position, code, msg string, sources map[string][]byte) diagnostic {
+	d := diagnostic{
+		File:     pos.Filename,
+		Line:     pos.Line,
+		Column:   pos.Column,
+		Severity: severityError,
+		Code:     code,
+		Message:  msg,
+	}
+	if pos.Filename == "go.mod" {
+		// go.mod is not Go source; its messages concern whole lines.
+		d.EndLine, d.EndColumn = lineEnd(sources[pos.Filename], pos)
+		return d
+	}
+	d.EndLine, d.EndColumn = end(sources[pos.Filename], pos)
+	return d
+}
+
+// end returns the position just past the token that starts at pos in
+// src, or pos itself if no token starts there.
+func end(src []byte, pos token.Position) (line, column int) {
+	line, column = pos.Line, pos.Column
+	if !pos.IsValid() || pos.Offset < 0 || pos.Offset >= len(src) {
+		return
+	}
+	f := token.NewFileSet().AddFile("", -1, len(src))
+	var s scanner.Scanner
+	s.Init(f, src, nil, 0)
+	for {
+		p, tok, lit := s.Scan()
+		if tok == token.EOF || f.Offset(p) > pos.Offset {
+			return
+		}
+		if f.Offset(p) < pos.Offset || (tok == token.SEMICOLON && lit == "\n") {
+			continue
+		}
+		n := len(lit)
+		if n == 0 {
+			n = len(tok.String())
+		}
+		e := f.Position(p + token.Pos(n))
+		return e.Line, e.Column
+	}
+}
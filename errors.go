@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// notFoundError reports that there is no archive for a package.
+type notFoundError struct {
+	path string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("cannot find package %q", e.path)
+}
+
+// corruptArchiveError reports an archive that cannot be decoded.
+type corruptArchiveError struct {
+	path string
+	err  error
+}
+
+func (e *corruptArchiveError) Error() string {
+	return fmt.Sprintf("corrupt archive for package %q: %v", e.path, e.err)
+}
+
+// corruptManifestError reports a manifest that cannot be parsed.
+type corruptManifestError struct {
+	err error
+}
+
+func (e *corruptManifestError) Error() string {
+	return fmt.Sprintf("corrupt %s: %v", manifestFile, e.err)
+}
+
+// corruptBundleError reports a bundle of the package directory that
+// cannot be indexed.
+type corruptBundleError struct {
+	uri string
+	err error
+}
+
+func (e *corruptBundleError) Error() string {
+	return fmt.Sprintf("corrupt bundle %s: %v", e.uri, e.err)
+}
+
+// corrupt reports whether err is the failure to read a manifest or a
+// bundle that reading again would not fix.
+func corrupt(err error) bool {
+	switch err.(type) {
+	case *corruptManifestError, *corruptBundleError:
+		return true
+	}
+	return false
+}
+
+// versionMismatchError reports an archive built by a toolchain other
+// than the one compiling.
+type versionMismatchError struct {
+	path   string
+	reason string
+}
+
+func (e *versionMismatchError) Error() string {
+	return fmt.Sprintf("archive for package %q was built by a different toolchain: %s", e.path, e.reason)
+}
+
+// versionConflictError reports a version of a module that go.mod
+// requires but cannot be used, at line of go.mod, or else at the
+// requirement of module, if go.mod has one.
+type versionConflictError struct {
+	line   int
+	module string
+	msg    string
+}
+
+func (e *versionConflictError) Error() string {
+	return e.msg
+}
+
+// requirement returns the line of b, a go.mod, that e concerns, or 0.
+// Conflicts found loading archives are remembered across compiles, so
+// their line is that of module in the go.mod of each.
+func (e *versionConflictError) requirement(b []byte) int {
+	if e.line > 0 || e.module == "" {
+		return e.line
+	}
+	f, _ := parseGoMod("go.mod", b)
+	return f.require[e.module].line
+}
+
+// versionConflicts are the conflicts of the versions go.mod requires.
+type versionConflicts []*versionConflictError
+
+func (l versionConflicts) Error() string {
+	return l[0].Error()
+}
+
+// networkError reports a failure to fetch an archive other than it not
+// existing.
+type networkError struct {
+	path string
+	err  error
+}
+
+func (e *networkError) Error() string {
+	return fmt.Sprintf("cannot fetch package %q: %v", e.path, e.err)
+}
+
+// readError returns the error for failing to read the archive of path
+// with err.
+func readError(path string, err error) error {
+	if os.IsNotExist(err) {
+		return &notFoundError{path: path}
+	}
+	if corrupt(err) {
+		return err
+	}
+	return &networkError{path: path, err: err}
+}
+
+// decodeError returns the error for failing to decode the archive of
+// path with err. Export data the type checker's importer cannot read is
+// the usual symptom of archives built by another toolchain.
+func decodeError(path string, err error) error {
+	if strings.Contains(err.Error(), "version") {
+		return &versionMismatchError{path: path, reason: err.Error()}
+	}
+	return &corruptArchiveError{path: path, err: err}
+}
+
+// importChainError is a failure to load a package that a file imports,
+// directly or not. chain holds the import paths from the file's import
+// to the package that failed.
+type importChainError struct {
+	chain []string
+	err   error
+}
+
+func (e *importChainError) Error() string {
+	if len(e.chain) < 2 {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%v (import chain: %s)", e.err, strings.Join(e.chain, " -> "))
+}
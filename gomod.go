@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// goMod is a go.mod file.
+type goMod struct {
+	module  string
+	require map[string]requirement // by module path
+	// replace holds replacements by module path, or by module@version
+	// for those of a single version.
+	replace map[string]replacement
+}
+
+// requirement is the version a go.mod requires of a module.
+type requirement struct {
+	version string
+	line    int
+}
+
+// replacement is the module, or the directory, a go.mod replaces a
+// module with.
+type replacement struct {
+	moduleVersion
+	line int
+}
+
+// moduleVersion is a version of a module, or a directory of the files
+// of a request holding one.
+type moduleVersion struct {
+	Path    string
+	Version string
+	Dir     string
+}
+
+func (mv moduleVersion) String() string {
+	if mv.Dir != "" {
+		return mv.Dir
+	}
+	return mv.Path + "@" + mv.Version
+}
+
+// parseGoMod parses the go.mod file b, whose errors are positioned in
+// name. The file is returned with the directives it could parse even if
+// there are errors.
+func parseGoMod(name string, b []byte) (*goMod, error) {
+	f := &goMod{require: make(map[string]requirement), replace: make(map[string]replacement)}
+	var list scanner.ErrorList
+	errorf := func(line int, format string, args ...interface{}) {
+		list.Add(linePosition(name, b, line), fmt.Sprintf(format, args...))
+	}
+	lines := strings.Split(string(b), "\n")
+	block := ""
+	for i, line := range lines {
+		if j := strings.Index(line, "//"); j >= 0 {
+			line = line[:j]
+		}
+		fields := strings.Fields(line)
+		for j, s := range fields {
+			if u, err := strconv.Unquote(s); err == nil {
+				fields[j] = u
+			}
+		}
+		switch {
+		case len(fields) == 0:
+		case block != "" && len(fields) == 1 && fields[0] == ")":
+			block = ""
+		case block != "":
+			f.directive(block, fields, i+1, errorf)
+		case len(fields) == 2 && fields[1] == "(":
+			block = fields[0]
+		default:
+			f.directive(fields[0], fields[1:], i+1, errorf)
+		}
+	}
+	if block != "" {
+		errorf(len(lines), "unterminated %s block", block)
+	}
+	if len(list) > 0 {
+		return f, list
+	}
+	return f, nil
+}
+
+// linePosition returns the position of the text of line in src, the
+// file name, past its indentation. Its offset is -1 if src has no such
+// line.
+func linePosition(name string, src []byte, line int) token.Position {
+	pos := token.Position{Filename: name, Line: line, Column: 1}
+	for n := 1; n < line; n++ {
+		i := bytes.IndexByte(src[pos.Offset:], '\n')
+		if i < 0 {
+			pos.Offset = -1
+			return pos
+		}
+		pos.Offset += i + 1
+	}
+	for pos.Offset < len(src) && (src[pos.Offset] == ' ' || src[pos.Offset] == '\t') {
+		pos.Offset++
+		pos.Column++
+	}
+	return pos
+}
+
+// lineEnd returns the position of the end of the text of the line at
+// pos in src.
+func lineEnd(src []byte, pos token.Position) (line, column int) {
+	if pos.Offset < 0 || pos.Offset > len(src) {
+		return pos.Line, pos.Column
+	}
+	text := src[pos.Offset:]
+	if i := bytes.IndexByte(text, '\n'); i >= 0 {
+		text = text[:i]
+	}
+	return pos.Line, pos.Column + len(bytes.TrimRight(text, " \t\r"))
+}
+
+// directive adds the directive verb with args, at line of the file.
+func (f *goMod) directive(verb string, args []string, line int, errorf func(int, string, ...interface{})) {
+	switch verb {
+	case "module":
+		if len(args) != 1 {
+			errorf(line, "usage: module module/path")
+			return
+		}
+		f.module = args[0]
+	case "go", "toolchain", "exclude", "retract":
+	case "require":
+		if len(args) != 2 {
+			errorf(line, "usage: require module/path v1.2.3")
+			return
+		}
+		if !validVersion(args[1]) {
+			errorf(line, "invalid version %q of module %s", args[1], args[0])
+			return
+		}
+		if r, ok := f.require[args[0]]; ok && r.version != args[1] {
+			errorf(line, "module %s required at both %s and %s", args[0], r.version, args[1])
+			return
+		}
+		f.require[args[0]] = requirement{version: args[1], line: line}
+	case "replace":
+		arrow := -1
+		for i, s := range args {
+			if s == "=>" {
+				arrow = i
+			}
+		}
+		old, repl := args, []string(nil)
+		if arrow >= 0 {
+			old, repl = args[:arrow], args[arrow+1:]
+		}
+		if len(old) < 1 || len(old) > 2 || len(repl) < 1 || len(repl) > 2 {
+			errorf(line, "usage: replace module/path [v1.2.3] => other/module v1.4.5 or directory")
+			return
+		}
+		key := old[0]
+		if len(old) == 2 {
+			key += "@" + old[1]
+		}
+		r := replacement{line: line}
+		switch {
+		case len(repl) == 2 && validVersion(repl[1]):
+			r.Path, r.Version = repl[0], repl[1]
+		case len(repl) == 1 && (strings.HasPrefix(repl[0], "./") || strings.HasPrefix(repl[0], "../")):
+			r.Dir = path.Clean(repl[0])
+		default:
+			errorf(line, "replacement of %s must be a module and version or a relative directory", key)
+			return
+		}
+		if p, ok := f.replace[key]; ok && p.moduleVersion != r.moduleVersion {
+			errorf(line, "%s replaced by both %s and %s", key, p, r)
+			return
+		}
+		f.replace[key] = r
+	default:
+		errorf(line, "unknown directive: %s", verb)
+	}
+}
+
+// replaced returns the module version, or directory, that version of
+// module is read from.
+func (f *goMod) replaced(module, version string) moduleVersion {
+	if r, ok := f.replace[module+"@"+version]; ok {
+		return r.moduleVersion
+	}
+	if r, ok := f.replace[module]; ok {
+		return r.moduleVersion
+	}
+	return moduleVersion{Path: module, Version: version}
+}
+
+// dirs returns the replacements of f by directories, by the path of the
+// module replaced.
+func (f *goMod) dirs() map[string]replacement {
+	dirs := make(map[string]replacement)
+	if f == nil {
+		return dirs
+	}
+	for key, r := range f.replace {
+		if r.Dir != "" {
+			dirs[strings.SplitN(key, "@", 2)[0]] = r
+		}
+	}
+	return dirs
+}
+
+// versions pins modules to versions, by module path.
+type versions map[string]moduleVersion
+
+// lookup returns the module that provides the package pkg, the longest
+// pinned prefix of pkg, and the version it is pinned to.
+func (v versions) lookup(pkg string) (module string, mv moduleVersion, ok bool) {
+	for module = pkg; module != "."; module = path.Dir(module) {
+		if mv, ok = v[module]; ok {
+			return module, mv, true
+		}
+	}
+	return "", moduleVersion{}, false
+}
+
+func (v versions) equal(w versions) bool {
+	if len(v) != len(w) {
+		return false
+	}
+	for module, mv := range v {
+		if w[module] != mv {
+			return false
+		}
+	}
+	return true
+}
+
+// versions returns the versions of the modules f requires, and of those
+// they require, directly or not, as minimal version selection chooses
+// them: the latest any of them requires. The requirements of modules
+// are read from proxy; without one, only those of f are known. A module
+// f requires at an earlier version than another module does is a
+// conflict, as is a requirement missing from the proxy.
+func (f *goMod) versions(proxy *moduleProxy) (versions, error) {
+	if f == nil {
+		return nil, nil
+	}
+	v := make(versions)
+	required := make(map[string]string)
+	var queue []string
+	for module, r := range f.require {
+		v[module] = f.replaced(module, r.version)
+		required[module] = r.version
+		queue = append(queue, module)
+	}
+	sort.Strings(queue)
+	if proxy == nil {
+		return v, nil
+	}
+	var conflicts versionConflicts
+	read := make(map[moduleVersion]bool)
+	for len(queue) > 0 {
+		module := queue[0]
+		queue = queue[1:]
+		mv := v[module]
+		if mv.Dir != "" || read[mv] {
+			continue
+		}
+		read[mv] = true
+		b, err := proxy.read(escapeModule(mv.Path) + "/@v/" + escapeModule(mv.Version) + ".mod")
+		if os.IsNotExist(err) {
+			conflicts = append(conflicts, &versionConflictError{line: f.require[module].line, msg: fmt.Sprintf("module %s: unknown version", mv)})
+			continue
+		}
+		if err != nil {
+			return nil, &networkError{path: module, err: err}
+		}
+		// As the go command does, parse what can be of the go.mod of a
+		// dependency.
+		dep, _ := parseGoMod(mv.String()+"/go.mod", b)
+		var deps []string
+		for m := range dep.require {
+			deps = append(deps, m)
+		}
+		sort.Strings(deps)
+		for _, m := range deps {
+			want := dep.require[m].version
+			have, ok := required[m]
+			if ok && compareVersions(want, have) <= 0 {
+				continue
+			}
+			if r, pinned := f.require[m]; pinned {
+				conflicts = append(conflicts, &versionConflictError{line: r.line, msg: fmt.Sprintf("%s requires %s@%s, but go.mod requires %s@%s", mv, m, want, m, have)})
+				continue
+			}
+			required[m] = want
+			v[m] = f.replaced(m, want)
+			queue = append(queue, m)
+		}
+	}
+	if len(conflicts) > 0 {
+		return nil, conflicts
+	}
+	return v, nil
+}
+
+// validVersion reports whether v is a semantic version, such as v1.2.3,
+// v0.0.0-20190101000000-0123456789ab or v2.0.0+incompatible.
+func validVersion(v string) bool {
+	_, _, ok := parseVersion(v)
+	return ok
+}
+
+// parseVersion returns the major, minor and patch numbers of the
+// semantic version v, and its prerelease identifiers.
+func parseVersion(v string) (nums [3]int, pre []string, ok bool) {
+	if !strings.HasPrefix(v, "v") {
+		return nums, nil, false
+	}
+	v = v[1:]
+	if i := strings.Index(v, "+"); i >= 0 {
+		v = v[:i]
+	}
+	if i := strings.Index(v, "-"); i >= 0 {
+		pre = strings.Split(v[i+1:], ".")
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return nums, nil, false
+	}
+	for i, s := range parts {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nums, nil, false
+		}
+		nums[i] = n
+	}
+	return nums, pre, true
+}
+
+// compareVersions returns -1, 0 or 1 as the semantic version a precedes,
+// is equal to or follows b.
+func compareVersions(a, b string) int {
+	an, apre, _ := parseVersion(a)
+	bn, bpre, _ := parseVersion(b)
+	for i := range an {
+		if c := compareInts(an[i], bn[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(apre) == 0 && len(bpre) == 0:
+		return 0
+	case len(apre) == 0:
+		return 1
+	case len(bpre) == 0:
+		return -1
+	}
+	for i := 0; i < len(apre) && i < len(bpre); i++ {
+		x, errx := strconv.Atoi(apre[i])
+		y, erry := strconv.Atoi(bpre[i])
+		switch {
+		case errx == nil && erry == nil:
+			if c := compareInts(x, y); c != 0 {
+				return c
+			}
+		case errx == nil:
+			return -1
+		case erry == nil:
+			return 1
+		case apre[i] != bpre[i]:
+			if apre[i] < bpre[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return compareInts(len(apre), len(bpre))
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"go/scanner"
+	"reflect"
+	"testing"
+)
+
+const testGoMod = `module example.com/hello // the module
+
+go 1.12
+
+require (
+	example.com/a v1.0.0
+	"example.com/b" v1.1.0
+)
+
+require example.com/d v1.0.0
+
+replace example.com/d => ./d
+
+replace example.com/a v1.0.0 => example.com/fork v1.0.1
+`
+
+func TestParseGoMod(t *testing.T) {
+	f, err := parseGoMod("go.mod", []byte(testGoMod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.module != "example.com/hello" {
+		t.Errorf("module is %q", f.module)
+	}
+	require := map[string]requirement{
+		"example.com/a": {"v1.0.0", 6},
+		"example.com/b": {"v1.1.0", 7},
+		"example.com/d": {"v1.0.0", 10},
+	}
+	if !reflect.DeepEqual(f.require, require) {
+		t.Errorf("require is %v, want %v", f.require, require)
+	}
+	for _, test := range []struct {
+		module, version string
+		mv              moduleVersion
+	}{
+		{"example.com/a", "v1.0.0", moduleVersion{Path: "example.com/fork", Version: "v1.0.1"}},
+		{"example.com/a", "v1.2.0", moduleVersion{Path: "example.com/a", Version: "v1.2.0"}},
+		{"example.com/d", "v1.0.0", moduleVersion{Dir: "d"}},
+	} {
+		if mv := f.replaced(test.module, test.version); mv != test.mv {
+			t.Errorf("%s@%s is replaced by %v, want %v", test.module, test.version, mv, test.mv)
+		}
+	}
+	if dirs := f.dirs(); len(dirs) != 1 || dirs["example.com/d"].Dir != "d" {
+		t.Errorf("dirs are %v", dirs)
+	}
+}
+
+func TestParseGoModErrors(t *testing.T) {
+	src := "module m\n\nrequire x v1\nrequire (\n\ty v1.0.0\n\ty v1.0.1\n)\nfoo bar\nreplace z => zz\nrequire (\n"
+	f, err := parseGoMod("go.mod", []byte(src))
+	list, ok := err.(scanner.ErrorList)
+	if !ok {
+		t.Fatalf("got %v, want a scanner.ErrorList", err)
+	}
+	want := []struct{ line, column int }{{3, 1}, {6, 2}, {8, 1}, {9, 1}, {11, 1}}
+	if len(list) != len(want) {
+		t.Fatalf("got %d errors, want %d: %v", len(list), len(want), list)
+	}
+	for i, e := range list {
+		if e.Pos.Line != want[i].line || e.Pos.Column != want[i].column {
+			t.Errorf("%v: want line %d, column %d", e, want[i].line, want[i].column)
+		}
+	}
+	if f.module != "m" || f.require["y"].version != "v1.0.0" {
+		t.Errorf("the directives that parse are dropped: %+v", f)
+	}
+}
+
+func TestLinePosition(t *testing.T) {
+	src := []byte("module m\n\nrequire (\n\texample.com/a v1.0.0  \n)")
+	for _, test := range []struct {
+		line                       int
+		column, endLine, endColumn int
+	}{
+		{1, 1, 1, 9},
+		{2, 1, 2, 1},
+		{4, 2, 4, 22},
+		{5, 1, 5, 2},
+		{6, 1, 6, 1},
+	} {
+		pos := linePosition("go.mod", src, test.line)
+		endLine, endColumn := lineEnd(src, pos)
+		if pos.Line != test.line || pos.Column != test.column || endLine != test.endLine || endColumn != test.endColumn {
+			t.Errorf("line %d: got %d:%d-%d:%d, want %d:%d-%d:%d", test.line, pos.Line, pos.Column, endLine, endColumn, test.line, test.column, test.endLine, test.endColumn)
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	proxy := newModuleProxy(memorySource{
+		"example.com/fork/@v/v1.0.1.mod": []byte("module example.com/a\nrequire example.com/c v1.2.0\nrequire example.com/b v1.0.0\n"),
+		"example.com/b/@v/v1.1.0.mod":    []byte("module example.com/b\nrequire example.com/c v1.3.0\n"),
+		"example.com/c/@v/v1.2.5.mod":    []byte("module example.com/c\n"),
+		"example.com/c/@v/v1.3.0.mod":    []byte("module example.com/c\ntoolchain go1.22\n"),
+		"example.com/c/@v/v1.4.0.mod":    []byte("module example.com/c\n"),
+	})
+	f, err := parseGoMod("go.mod", []byte(testGoMod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := f.versions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 3 {
+		t.Errorf("without a proxy, got %v, want the requirements of go.mod", v)
+	}
+	v, err = f.versions(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := versions{
+		"example.com/a": {Path: "example.com/fork", Version: "v1.0.1"},
+		"example.com/b": {Path: "example.com/b", Version: "v1.1.0"},
+		"example.com/c": {Path: "example.com/c", Version: "v1.3.0"},
+		"example.com/d": {Dir: "d"},
+	}
+	if !v.equal(want) {
+		t.Errorf("got %v, want %v", v, want)
+	}
+	if module, mv, ok := v.lookup("example.com/c/sub/pkg"); !ok || module != "example.com/c" || mv.Version != "v1.3.0" {
+		t.Errorf("lookup: got %s, %v, %v", module, mv, ok)
+	}
+	if _, _, ok := v.lookup("example.com/e"); ok {
+		t.Error("lookup of a module not required succeeded")
+	}
+
+	f.require["example.com/c"] = requirement{"v1.2.5", 20}
+	f.require["example.com/e"] = requirement{"v9.0.0", 21}
+	_, err = f.versions(proxy)
+	conflicts, ok := err.(versionConflicts)
+	if !ok || len(conflicts) != 2 {
+		t.Fatalf("got %v, want 2 conflicts", err)
+	}
+	for _, e := range conflicts {
+		if e.line != 20 && e.line != 21 {
+			t.Errorf("conflict %q at line %d", e, e.line)
+		}
+	}
+
+	f.require["example.com/c"] = requirement{"v1.4.0", 20}
+	delete(f.require, "example.com/e")
+	if v, err = f.versions(proxy); err != nil {
+		t.Fatal(err)
+	}
+	if v["example.com/c"].Version != "v1.4.0" {
+		t.Errorf("got %v, want go.mod's later version of example.com/c", v["example.com/c"])
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		c    int
+	}{
+		{"v1.2.3", "v1.2.3", 0},
+		{"v1.2.3", "v1.10.0", -1},
+		{"v2.0.0", "v1.99.99", 1},
+		{"v1.0.0-rc.1", "v1.0.0", -1},
+		{"v1.0.0-alpha", "v1.0.0-alpha.1", -1},
+		{"v1.0.0-alpha.1", "v1.0.0-alpha.beta", -1},
+		{"v1.0.0-2", "v1.0.0-10", -1},
+		{"v1.0.0-2", "v1.0.0-beta", -1},
+		{"v0.0.0-20190101000000-0123456789ab", "v0.0.0-20200101000000-0123456789ab", -1},
+		{"v2.0.0+incompatible", "v2.0.0", 0},
+	} {
+		if c := compareVersions(test.a, test.b); c != test.c {
+			t.Errorf("compareVersions(%s, %s) = %d, want %d", test.a, test.b, c, test.c)
+		}
+		if c := compareVersions(test.b, test.a); c != -test.c {
+			t.Errorf("compareVersions(%s, %s) = %d, want %d", test.b, test.a, c, -test.c)
+		}
+	}
+}
+
+func TestValidVersion(t *testing.T) {
+	for v, want := range map[string]bool{
+		"v1.2.3":                             true,
+		"v0.0.0-20190101000000-0123456789ab": true,
+		"v2.0.0+incompatible":                true,
+		"v1.2":                               false,
+		"1.2.3":                              false,
+		"v1.2.x":                             false,
+		"latest":                             false,
+	} {
+		if got := validVersion(v); got != want {
+			t.Errorf("validVersion(%q) = %v, want %v", v, got, want)
+		}
+	}
+}
@@ -2,10 +2,13 @@ package important
 
 import (
 	"bytes"
+	"encoding/json"
 	"go/ast"
 	"go/format"
 	"go/parser"
+	"go/scanner"
 	"go/token"
+	"io"
 	"path"
 	"strings"
 
@@ -17,9 +20,71 @@ func importPathToName(importPath string) (packageName string) {
 	return path.Base(importPath)
 }
 
+// ReadImports adds the symbols of an imports.json file, a JSON object
+// mapping package-qualified symbols to import paths, read from r.
+func ReadImports(r io.Reader) error {
+	m := make(map[string]string)
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return err
+	}
+	AddImports(m)
+	return nil
+}
+
+// Process formats code, a Go source file or a txtar archive of files (see
+// Split), adding and removing the imports of its Go files.
 func Process(code []byte) ([]byte, error) {
+	return processFiles(code, true)
+}
+
+// Format formats the Go files of code, a Go source file or a txtar
+// archive of files, as gofmt does.
+func Format(code []byte) ([]byte, error) {
+	return processFiles(code, false)
+}
+
+// processFiles formats the Go files of the archive code, fixing their
+// imports if imports is set, and returns the archive. Syntax errors of
+// every file are returned together.
+func processFiles(code []byte, imports bool) ([]byte, error) {
+	files, err := Split(code)
+	if err != nil {
+		return nil, err
+	}
+	var list scanner.ErrorList
+	for i, f := range files {
+		if !strings.HasSuffix(f.Name, ".go") {
+			continue
+		}
+		out, err := processFile(f.Name, f.Data, imports)
+		if l, ok := err.(scanner.ErrorList); ok {
+			list = append(list, l...)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[i].Data = out
+	}
+	if len(list) > 0 {
+		return nil, list
+	}
+	return Join(files), nil
+}
+
+func processFile(name string, code []byte, imports bool) ([]byte, error) {
+	if !imports {
+		out, err := format.Source(code)
+		// format.Source reports positions without a file name.
+		if l, ok := err.(scanner.ErrorList); ok {
+			for _, e := range l {
+				e.Pos.Filename = name
+			}
+		}
+		return out, err
+	}
 	fset := new(token.FileSet)
-	f, err := parser.ParseFile(fset, "prog.go", code, parser.ParseComments|parser.AllErrors)
+	f, err := parser.ParseFile(fset, name, code, parser.ParseComments|parser.AllErrors)
 	if err != nil {
 		return nil, err
 	}
@@ -112,6 +177,8 @@ func (v *Visitor) Visit(node ast.Node) (w ast.Visitor) {
 }
 
 func findImport(shortPkg string, symbols map[string]bool) (importPath string, rename bool, err error) {
+	stdlibMu.RLock()
+	defer stdlibMu.RUnlock()
 	for symbol := range symbols {
 		path := stdlib[shortPkg+"."+symbol]
 		if path == "" {
@@ -3,11 +3,11 @@
 package important
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
 )
 
+// Imports reads pkg/imports.json; see ReadImports.
 func Imports() error {
 	res, err := http.Get("pkg/imports.json")
 	if err != nil {
@@ -17,11 +17,5 @@ func Imports() error {
 	if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("imports: %s", res.Status)
 	}
-	decode := json.NewDecoder(res.Body).Decode
-	m := make(map[string]string)
-	if err = decode(&m); err != nil {
-		return err
-	}
-	AddImports(m)
-	return nil
+	return ReadImports(res.Body)
 }
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"go/parser"
 	"go/printer"
+	"go/scanner"
 	"go/token"
+	"strings"
 	"testing"
 )
 
@@ -65,3 +67,85 @@ func TestAdd(t *testing.T) {
 	}
 	t.Log(buf.String())
 }
+
+const testfile3 = `
+package main
+
+func main() {
+	widget.Spin()
+}
+`
+
+func TestReadImports(t *testing.T) {
+	err := ReadImports(strings.NewReader(`{"widget.Spin": "example.com/widget"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := Process([]byte(testfile3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte(`import "example.com/widget"`)) {
+		t.Fatalf("import not added:\n%s", out)
+	}
+}
+
+const testarchive = `package main
+
+func main() {
+	fmt.Println(greeting)
+}
+-- greeting.go --
+package main
+
+var   greeting = "Hello World"
+-- data.txt --
+not   Go
+`
+
+func TestSplit(t *testing.T) {
+	files, err := Split([]byte(testarchive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, " ") != "prog.go greeting.go data.txt" {
+		t.Fatalf("wrong files %q", names)
+	}
+	if out := Join(files); string(out) != testarchive {
+		t.Fatalf("archive not reassembled:\n%s", out)
+	}
+	files, err = Split([]byte(testfile2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "prog.go" || string(Join(files)) != testfile2 {
+		t.Fatalf("source split as %v", files)
+	}
+	if _, err = Split([]byte("-- a.go --\n-- a.go --\n")); err == nil {
+		t.Fatal("duplicate file name accepted")
+	}
+	if _, err = Split([]byte("-- ../a.go --\n")); err == nil {
+		t.Fatal("invalid file name accepted")
+	}
+}
+
+func TestProcessArchive(t *testing.T) {
+	out, err := Process([]byte(testarchive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`import "fmt"`, "var greeting = ", "-- data.txt --\nnot   Go\n"} {
+		if !bytes.Contains(out, []byte(s)) {
+			t.Fatalf("%q not in:\n%s", s, out)
+		}
+	}
+	_, err = Format([]byte(testarchive + "-- bad.go --\npackage main\nfunc {\n"))
+	l, ok := err.(scanner.ErrorList)
+	if !ok || l[0].Pos.Filename != "bad.go" {
+		t.Fatalf("wrong error %v", err)
+	}
+}
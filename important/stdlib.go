@@ -1,6 +1,12 @@
 package important
 
+import "sync"
+
+var stdlibMu sync.RWMutex
+
 func AddImports(m map[string]string) {
+	stdlibMu.Lock()
+	defer stdlibMu.Unlock()
 	for k, v := range m {
 		stdlib[k] = v
 	}
@@ -0,0 +1,77 @@
+package important
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"golang.org/x/tools/txtar"
+)
+
+// progName is the name of the file of a source that is not an archive,
+// and of the text before the first file of one.
+const progName = "prog.go"
+
+// File is a file of a txtar archive.
+type File struct {
+	Name string
+	Data []byte
+}
+
+// Split returns the files of src, a txtar archive of files separated by
+// "-- name --" lines, as on the Go playground. Text before the first
+// file is prog.go, so a source without such lines is prog.go alone.
+func Split(src []byte) ([]File, error) {
+	a := txtar.Parse(src)
+	var files []File
+	seen := make(map[string]bool)
+	if len(bytes.TrimSpace(a.Comment)) > 0 {
+		files = append(files, File{Name: progName, Data: a.Comment})
+		seen[progName] = true
+	}
+	for _, f := range a.Files {
+		if !validName(f.Name) {
+			return nil, fmt.Errorf("invalid file name %q", f.Name)
+		}
+		if seen[f.Name] {
+			return nil, fmt.Errorf("duplicate file name %q", f.Name)
+		}
+		seen[f.Name] = true
+		files = append(files, File{Name: f.Name, Data: f.Data})
+	}
+	if len(files) == 0 {
+		files = append(files, File{Name: progName, Data: src})
+	}
+	return files, nil
+}
+
+// validName reports whether name is a relative, clean slash-separated
+// path.
+func validName(name string) bool {
+	if name == "" || name[0] == '/' {
+		return false
+	}
+	for _, s := range strings.Split(name, "/") {
+		if s == "" || s == "." || s == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// Join returns the archive of files, the inverse of Split: a prog.go
+// that comes first has no header, and alone is the whole source.
+func Join(files []File) []byte {
+	if len(files) == 1 && files[0].Name == progName {
+		return files[0].Data
+	}
+	a := new(txtar.Archive)
+	if len(files) > 0 && files[0].Name == progName {
+		a.Comment = files[0].Data
+		files = files[1:]
+	}
+	for _, f := range files {
+		a.Files = append(a.Files, txtar.File{Name: f.Name, Data: f.Data})
+	}
+	return txtar.Format(a)
+}
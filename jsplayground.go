@@ -6,248 +6,546 @@ import (
 	"bytes"
 	"fmt"
 	"go/ast"
-	"go/format"
 	"go/parser"
 	"go/scanner"
 	"go/token"
 	"go/types"
-	"io/ioutil"
-	"net/http"
+	"sort"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/gopherjs/gopherjs/compiler"
 	"github.com/gopherjs/gopherjs/js"
 	"github.com/j7b/jsplayground/important"
 )
 
-var syncImport bool
-
-var mustImport bool
-
-var errAgain = fmt.Errorf("try again")
-
-var fileSet = token.NewFileSet()
-
 type formatter struct {
+	*cancellation
+	cache   *packageCache
 	code    []byte
 	imports bool
 }
 
 func (f *formatter) format(resolve, reject func(interface{})) {
-	var out []byte
-	var err error
-	switch f.imports {
-	case true:
-		out, err = important.Process(f.code)
-	case false:
-		out, err = format.Source(f.code)
-	}
-	if err == nil {
-		resolve(string(out))
-		return
-	}
-	reject(err.Error())
+	go func() {
+		var out []byte
+		var err error
+		switch f.imports {
+		case true:
+			f.cache.loadImports()
+			if f.canceled() {
+				break
+			}
+			out, err = important.Process(f.code)
+		case false:
+			out, err = important.Format(f.code)
+		}
+		if f.canceled() {
+			reject(objects([]diagnostic{canceled()}))
+			return
+		}
+		if err == nil {
+			resolve(string(out))
+			return
+		}
+		sources := make(map[string][]byte)
+		files, _ := important.Split(f.code)
+		for _, file := range files {
+			sources[file.Name] = file.Data
+		}
+		reject(objects(diagnose(err, codeSyntax, sources)))
+	}()
 }
 
 func promise(f func(resolve, reject func(interface{}))) *js.Object {
 	return js.Global.Get("Promise").New(f)
 }
 
+// await blocks until the Javascript promise p settles.
+func await(p *js.Object) (*js.Object, error) {
+	type settled struct {
+		value *js.Object
+		err   error
+	}
+	c := make(chan settled, 1)
+	p.Call("then", func(value *js.Object) {
+		c <- settled{value: value}
+	}, func(reason *js.Object) {
+		c <- settled{err: &js.Error{Object: reason}}
+	})
+	s := <-c
+	return s.value, s.err
+}
+
+// Go is the API installed as the Javascript global Go. Each Compile or
+// CompileFiles call is an independent request; requests share only the
+// package cache.
 type Go struct {
-	packages      map[string]*compiler.Archive
-	packagerr     map[string]error
-	importContext *compiler.ImportContext
-	code          []byte
-	packageuri    string
+	cache *packageCache
+
+	mu         sync.Mutex // guards onProgress
+	onProgress *js.Object
 }
 
-func (g *Go) loadpkg(path string) {
-	if g.packagerr == nil {
-		g.packagerr = make(map[string]error)
-	}
-	if _, ok := g.packages[path]; ok {
+// request is the state of a single Compile or CompileFiles call.
+type request struct {
+	*cancellation
+	cache    *packageCache
+	files    map[string][]byte
+	options  options
+	fileSet  *token.FileSet
+	progress func(progress)
+	err      error  // of splitting the source into files
+	mod      *goMod // the go.mod of the files, if any
+}
+
+// options are the settings Javascript may pass to Compile and
+// CompileFiles as {sourceMap, signal}.
+type options struct {
+	// signal is an AbortSignal cancelling the request.
+	signal *js.Object
+	// sourceMap is set by sourceMap: true to resolve with a source map.
+	sourceMap bool
+	// inline is set by sourceMap: "inline" to also append the source
+	// map to the code.
+	inline bool
+}
+
+func readOptions(o *js.Object) (opts options) {
+	if o == nil || o == js.Undefined {
 		return
 	}
-	if _, ok := g.packagerr[path]; ok {
-		return
+	opts.signal = o.Get("signal")
+	switch v := o.Get("sourceMap").Interface().(type) {
+	case bool:
+		opts.sourceMap = v
+	case string:
+		opts.inline = v == "inline"
+		opts.sourceMap = opts.inline
 	}
-	res, err := http.Get(g.packageuri + "pkg/" + path + ".a")
-	if err != nil {
-		g.packagerr[path] = err
-		return
+	return
+}
+
+// PackageURI reads archives and imports.json from the pkg directory
+// below uri. Each argument is a URI or an array of them; URIs after the
+// first are mirrors, tried in turn when reading from those before them
+// fails. Archives already loaded are dropped.
+func (g *Go) PackageURI(uris ...*js.Object) {
+	var list []string
+	for _, o := range uris {
+		if js.Global.Get("Array").Call("isArray", o).Bool() {
+			for i := 0; i < o.Length(); i++ {
+				list = append(list, o.Index(i).String())
+			}
+			continue
+		}
+		list = append(list, o.String())
 	}
-	if res.StatusCode != http.StatusOK {
-		g.packagerr[path] = fmt.Errorf(res.Status)
-		return
+	g.cache.reset(uriSource(list...))
+}
+
+// uriSource returns the source of the pkg directories below uris, tried
+// in turn, kept in browser storage if they have a manifest.
+func uriSource(uris ...string) PackageSource {
+	if len(uris) == 0 {
+		uris = []string{""}
 	}
-	defer res.Body.Close()
-	b, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		g.packagerr[path] = err
-		return
+	var sources mirrorSource
+	for _, uri := range uris {
+		sources = append(sources, httpSource{base: uri + "pkg/"})
 	}
-	p, err := compiler.ReadArchive(path+".a", path, bytes.NewReader(b), g.importContext.Packages)
+	var source PackageSource = sources
+	if len(sources) == 1 {
+		source = sources[0]
+	}
+	return &cacheSource{name: "jsplayground:" + uris[0] + "pkg/", source: source, versioned: true}
+}
+
+// PackageSource sets where archives are read from; see newPackageSource.
+// Archives already loaded are dropped.
+func (g *Go) PackageSource(spec *js.Object) {
+	source, err := newPackageSource(spec)
 	if err != nil {
-		g.packagerr[path] = err
+		panic(&js.Error{Object: js.Global.Get("Error").New(err.Error())})
+	}
+	g.cache.reset(source)
+}
+
+// ModuleProxy sets the Go module proxy packages there are no archives
+// for are compiled from: a URI, such as https://proxy.golang.org, or a
+// source spec as taken by PackageSource holding the files of one. Null
+// stops compiling them.
+func (g *Go) ModuleProxy(spec *js.Object) {
+	if spec == nil || spec == js.Undefined || spec.String() == "" {
+		g.cache.setProxy(nil)
 		return
 	}
-	g.packages[path] = p
+	var source PackageSource = httpSource{base: strings.TrimSuffix(spec.String(), "/") + "/"}
+	if _, ok := spec.Interface().(string); !ok {
+		var err error
+		if source, err = newPackageSource(spec); err != nil {
+			panic(&js.Error{Object: js.Global.Get("Error").New(err.Error())})
+		}
+	}
+	g.cache.setProxy(newModuleProxy(source))
+}
+
+// ClearCache forgets the failure to load the package path, so the next
+// compile tries again. Without a path, it drops everything loaded,
+// including copies kept in browser storage. It returns a Promise that
+// resolves when done.
+func (g *Go) ClearCache(path *js.Object) *js.Object {
+	p := ""
+	if path != nil && path != js.Undefined {
+		p = path.String()
+	}
+	return promise(func(resolve, reject func(interface{})) {
+		go func() {
+			g.cache.forget(p)
+			resolve(nil)
+		}()
+	})
 }
 
-func (g *Go) PackageURI(uri string) {
-	g.packageuri = uri
+// Preload loads the archives of paths and everything they import, so
+// that compiles importing them need not wait. It returns a Promise that
+// resolves to {packages, bytes}, the number of packages loaded and of
+// bytes read for them, and rejects with diagnostics. onProgress, if
+// given, is called with {path, size, bytes, packages, total} as each
+// package is loaded, as are functions set by OnProgress.
+func (g *Go) Preload(paths []string, onProgress *js.Object) *js.Object {
+	report := g.progress(onProgress)
+	return promise(func(resolve, reject func(interface{})) {
+		go func() {
+			var last progress
+			err := g.cache.prefetch("", paths, func(p progress) {
+				last = p
+				report(p)
+			}, nil)
+			if err != nil {
+				reject(objects(diagnose(err, codeImport, nil)))
+				return
+			}
+			resolve(js.M{"packages": last.Packages, "bytes": last.Bytes})
+		}()
+	})
+}
+
+// OnProgress sets f to be called with {path, size, bytes, packages,
+// total} as each package a compile or preload needs is loaded; see
+// Preload. A null f stops the calls.
+func (g *Go) OnProgress(f *js.Object) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.onProgress = f
 }
 
-func (g *Go) SyncImport(b bool) {
-	syncImport = b
+// progress returns the function reporting the progress of a load to f,
+// if given, and to the function set by OnProgress.
+func (g *Go) progress(f *js.Object) func(progress) {
+	g.mu.Lock()
+	all := g.onProgress
+	g.mu.Unlock()
+	return func(p progress) {
+		o := p.object()
+		for _, f := range []*js.Object{f, all} {
+			if f != nil && f != js.Undefined {
+				f.Invoke(o)
+			}
+		}
+	}
 }
 
+// SyncImport has no effect: archives are always loaded before type
+// checking. It is kept for compatibility.
+func (g *Go) SyncImport(b bool) {}
+
 func (g *Go) RedirectConsole(f func(string)) {
 	js.Global.Set("goPrintToConsole", js.InternalObject(func(b []byte) {
 		f(string(b))
 	}))
 }
 
-func (g *Go) Compile(src string) *js.Object {
-	g.code = []byte(src)
-	return promise(g.compile)
+// Compile compiles src, a Go source file or a txtar archive of files as
+// on the Go playground: "-- name --" lines begin the files, and text
+// before the first of them is prog.go.
+func (g *Go) Compile(src string, opts *js.Object) *js.Object {
+	r := g.sourceRequest(src, opts)
+	return r.bind(promise(r.compile), r.options.signal)
 }
 
-func (g *Go) compile(resolve, reject func(interface{})) {
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				reject(fmt.Sprintf("PANIC: %#v", r))
+// CompileFiles compiles package main from files, a map of file names
+// to sources.
+func (g *Go) CompileFiles(files map[string]string, opts *js.Object) *js.Object {
+	r := g.newRequest(files, opts)
+	return r.bind(promise(r.compile), r.options.signal)
+}
+
+// Run compiles src like Compile and runs it in a Web Worker, returning a
+// Promise that resolves when the program exits; see runner.run. It
+// rejects with diagnostics if src does not compile or cannot be run.
+func (g *Go) Run(src string, opts *js.Object) *js.Object {
+	r := g.sourceRequest(src, opts)
+	run := readRunOptions(opts)
+	p := promise(func(resolve, reject func(interface{})) {
+		go func() {
+			p, diags := r.build()
+			if diags != nil {
+				reject(objects(diags))
+				return
 			}
-		}()
-		file, err := parser.ParseFile(fileSet, "prog.go", g.code, parser.ParseComments)
-		if err != nil {
-			if list, ok := err.(scanner.ErrorList); ok {
-				errors := make([]string, len(list))
-				for i, entry := range list {
-					errors[i] = entry.Error()
-				}
-				reject(strings.Join(errors, "\n"))
+			result, err := run.run(p.code, r.done)
+			if err == errCanceled {
+				reject(objects([]diagnostic{canceled()}))
 				return
 			}
-			reject(err.Error())
-			return
-		}
-		mustImport = true
-		mainPkg, err := compiler.Compile("main", []*ast.File{file}, fileSet, g.importContext, false)
-		mustImport = syncImport
-		g.packages["main"] = mainPkg
-		if err != nil {
-			if list, ok := err.(compiler.ErrorList); ok {
-				errors := make([]string, len(list))
-				for i, entry := range list {
-					errors[i] = entry.Error()
-				}
-				reject(strings.Join(errors, "\n"))
+			if err != nil {
+				reject(objects(diagnose(err, codeRun, nil)))
 				return
 			}
-			reject(err.Error())
-			return
-		}
-		var allPkgs []*compiler.Archive
-		allPkgs, err = compiler.ImportDependencies(mainPkg, g.importContext.Import)
-		for len(getting) > 0 {
-			time.Sleep(time.Millisecond)
-			allPkgs, err = compiler.ImportDependencies(mainPkg, g.importContext.Import)
-		}
-		allPkgs, err = compiler.ImportDependencies(mainPkg, g.importContext.Import)
-		if err != nil {
-			reject(err.Error())
-			return
-		}
-		jsCode := new(bytes.Buffer)
-		compiler.WriteProgramCode(allPkgs, &compiler.SourceMapFilter{Writer: jsCode})
-		resolve(jsCode.String())
-	}()
+			result["warnings"] = objects(p.warnings)
+			resolve(result)
+		}()
+	})
+	return r.bind(p, r.options.signal)
 }
 
-func (g *Go) Format(src string, imports bool) *js.Object {
-	code := []byte(src)
-	f := &formatter{code: code, imports: imports}
-	return promise(f.format)
+func (g *Go) newRequest(files map[string]string, opts *js.Object) *request {
+	r := &request{
+		cancellation: newCancellation(),
+		cache:        g.cache,
+		files:        make(map[string][]byte, len(files)),
+		options:      readOptions(opts),
+		fileSet:      token.NewFileSet(),
+		progress:     g.progress(nil),
+	}
+	for name, src := range files {
+		r.files[name] = []byte(src)
+	}
+	return r
 }
 
-var getting = make(map[string]struct{})
-
-func imports() {
-	if err := important.Imports(); err != nil {
-		js.Global.Get("console").Call("warn", "additional imports: "+err.Error())
+// sourceRequest returns the request compiling src, which is split into
+// files by important.Split.
+func (g *Go) sourceRequest(src string, opts *js.Object) *request {
+	r := g.newRequest(nil, opts)
+	files, err := important.Split([]byte(src))
+	r.err = err
+	for _, f := range files {
+		r.files[f.Name] = f.Data
 	}
+	return r
 }
 
-func main() {
-	go imports()
-	g := new(Go)
-	g.packages = make(map[string]*compiler.Archive)
-	g.importContext = &compiler.ImportContext{
-		Packages: make(map[string]*types.Package),
-		Import: func(path string) (a *compiler.Archive, err error) {
-			if pkg, found := g.packages[path]; found {
-				return pkg, nil
-			}
-			if err, found := g.packagerr[path]; found {
-				return nil, err
+// parse parses the Go files of r.files in name order, collecting the
+// errors of every file, and returns them by directory, "." being that
+// of package main. go.mod is parsed into r.mod; other files are skipped
+// with a warning.
+func (r *request) parse() (map[string][]*ast.File, []diagnostic, error) {
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	names := make([]string, 0, len(r.files))
+	for name := range r.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make(map[string][]*ast.File)
+	var warnings []diagnostic
+	var list scanner.ErrorList
+	for _, name := range names {
+		switch {
+		case name == "go.mod":
+			mod, err := parseGoMod(name, r.files[name])
+			if l, ok := err.(scanner.ErrorList); ok {
+				list = append(list, l...)
 			}
-			if mustImport {
-				res, err := http.Get("pkg/" + path + ".a")
-				if err != nil {
-					g.packagerr[path] = err
-					return nil, err
-				}
-				defer res.Body.Close()
-				if res.StatusCode != http.StatusOK {
-					g.packagerr[path] = fmt.Errorf(res.Status)
-					return nil, err
-				}
-				b, err := ioutil.ReadAll(res.Body)
-				if err != nil {
-					g.packagerr[path] = err
-					return nil, err
-				}
-				p, err := compiler.ReadArchive(path+".a", path, bytes.NewReader(b), g.importContext.Packages)
-				if err != nil {
-					g.packagerr[path] = err
-					return nil, err
-				}
-				g.packages[path] = p
-				return p, nil
+			r.mod = mod
+			continue
+		case !strings.HasSuffix(name, ".go"):
+			warnings = append(warnings, skipped(name, "not a Go source file"))
+			continue
+		case strings.HasSuffix(name, "_test.go"):
+			warnings = append(warnings, skipped(name, "test files are not compiled"))
+			continue
+		}
+		file, err := parser.ParseFile(r.fileSet, name, r.files[name], parser.ParseComments)
+		if err != nil {
+			if l, ok := err.(scanner.ErrorList); ok {
+				list = append(list, l...)
+				continue
 			}
-			if _, ok := getting[path]; ok {
-				return new(compiler.Archive), nil
+			return nil, nil, err
+		}
+		dir := packageDir(name)
+		files[dir] = append(files[dir], file)
+	}
+	if len(list) > 0 {
+		return nil, nil, list
+	}
+	if len(files["."]) == 0 {
+		return nil, nil, fmt.Errorf("no Go files to compile")
+	}
+	return files, warnings, nil
+}
+
+func skipped(name, reason string) diagnostic {
+	return diagnostic{
+		File:     name,
+		Severity: severityWarning,
+		Code:     codeSyntax,
+		Message:  "skipping " + name + ": " + reason,
+	}
+}
+
+// importer returns the compiler.ImportContext of r, which imports the
+// archives of local, those of its local packages, and of the cache. Its
+// packages are a copy of those of the cache, so the types of the local
+// packages are not seen by other requests. The caller holds check.
+func (r *request) importer(local map[string]*compiler.Archive) *compiler.ImportContext {
+	packages := make(map[string]*types.Package, len(r.cache.packages))
+	for path, pkg := range r.cache.packages {
+		packages[path] = pkg
+	}
+	return &compiler.ImportContext{
+		Packages: packages,
+		Import: func(path string) (*compiler.Archive, error) {
+			if a, ok := local[path]; ok {
+				return a, nil
 			}
-			getting[path] = struct{}{}
-			go func() {
-				defer delete(getting, path)
-				res, err := http.Get("pkg/" + path + ".a")
-				if err != nil {
-					g.packagerr[path] = err
-					return
-				}
-				defer res.Body.Close()
-				if res.StatusCode != http.StatusOK {
-					g.packagerr[path] = fmt.Errorf(res.Status)
-					return
-				}
-				b, err := ioutil.ReadAll(res.Body)
-				if err != nil {
-					g.packagerr[path] = err
-					return
-				}
-				p, err := compiler.ReadArchive(path+".a", path, bytes.NewReader(b), g.importContext.Packages)
-				if err != nil {
-					g.packagerr[path] = err
-					return
-				}
-				g.packages[path] = p
-			}()
-			return new(compiler.Archive), nil
+			return r.cache.lookup(path)
 		},
 	}
+}
+
+// program is the result of compiling a request.
+type program struct {
+	code      string
+	sourceMap string
+	warnings  []diagnostic
+}
+
+func (p *program) object() js.M {
+	o := js.M{"code": p.code, "warnings": objects(p.warnings)}
+	if p.sourceMap != "" {
+		o["sourceMap"] = p.sourceMap
+	}
+	return o
+}
+
+func (r *request) compile(resolve, reject func(interface{})) {
+	go func() {
+		p, diags := r.build()
+		if diags != nil {
+			reject(objects(diags))
+			return
+		}
+		resolve(p.object())
+	}()
+}
+
+// build parses, type checks and links r, returning the program or the
+// diagnostics of the stage that failed. If r is cancelled, build stops
+// at the end of the stage running.
+func (r *request) build() (p *program, diags []diagnostic) {
+	defer func() {
+		if e := recover(); e != nil {
+			p, diags = nil, diagnose(fmt.Errorf("PANIC: %#v", e), codeInternal, nil)
+		}
+	}()
+	dirs, warnings, err := r.parse()
+	if err != nil {
+		return nil, diagnose(err, codeSyntax, r.files)
+	}
+	files := dirs["."]
+	local, err := r.localPackages(dirs)
+	if err != nil {
+		return nil, diagnose(err, codeImport, r.files)
+	}
+	if r.canceled() {
+		return nil, []diagnostic{canceled()}
+	}
+	// Without a go.mod, modules are compiled at their latest version.
+	var v versions
+	if r.mod != nil {
+		if v, err = r.mod.versions(r.cache.moduleProxy()); err != nil {
+			return nil, diagnose(err, codeImport, r.files)
+		}
+	}
+	if err = r.cache.pin(v, r.done); err == errCanceled {
+		return nil, []diagnostic{canceled()}
+	}
+	if err != nil {
+		return nil, diagnose(err, codeImport, r.files)
+	}
+	defer r.cache.unpin()
+	if r.canceled() {
+		return nil, []diagnostic{canceled()}
+	}
+	err = r.cache.prefetch("", local.imports(files), r.progress, r.done)
+	if err == errCanceled || r.canceled() {
+		return nil, []diagnostic{canceled()}
+	}
+	if err != nil {
+		return nil, r.importDiagnostics(local.files(files), err)
+	}
+	r.cache.check.Lock()
+	defer r.cache.check.Unlock()
+	importContext, err := r.compileLocal(local)
+	if err != nil {
+		return nil, diagnose(err, codeImport, r.files)
+	}
+	if r.canceled() {
+		return nil, []diagnostic{canceled()}
+	}
+	mainPkg, err := compiler.Compile("main", files, r.fileSet, importContext, false)
+	if err != nil {
+		return nil, diagnose(err, codeImport, r.files)
+	}
+	if r.canceled() {
+		return nil, []diagnostic{canceled()}
+	}
+	allPkgs, err := compiler.ImportDependencies(mainPkg, importContext.Import)
+	if err != nil {
+		return nil, diagnose(err, codeLink, r.files)
+	}
+	if r.canceled() {
+		return nil, []diagnostic{canceled()}
+	}
+	jsCode := new(bytes.Buffer)
+	filter := &compiler.SourceMapFilter{Writer: jsCode}
+	var mapper *sourceMapper
+	if r.options.sourceMap {
+		mapper = newSourceMapper(r.files)
+		filter.MappingCallback = mapper.mapping
+	}
+	if err = compiler.WriteProgramCode(allPkgs, filter); err != nil {
+		return nil, diagnose(err, codeLink, r.files)
+	}
+	p = &program{warnings: warnings}
+	if mapper != nil {
+		if p.sourceMap, err = mapper.encode(); err != nil {
+			return nil, diagnose(err, codeLink, r.files)
+		}
+		if r.options.inline {
+			jsCode.WriteString(inline(p.sourceMap))
+		}
+	}
+	p.code = jsCode.String()
+	return p, nil
+}
+
+// Format formats src, adding and removing imports if imports is set. An
+// archive of files, as taken by Compile, has each Go file formatted.
+// opts may be {signal}, an AbortSignal cancelling the request.
+func (g *Go) Format(src string, imports bool, opts *js.Object) *js.Object {
+	code := []byte(src)
+	f := &formatter{cancellation: newCancellation(), cache: g.cache, code: code, imports: imports}
+	return f.bind(promise(f.format), readOptions(opts).signal)
+}
+
+func main() {
+	g := &Go{cache: newPackageCache(uriSource())}
 	js.Global.Set("Go", js.MakeWrapper(g))
+	serveWorker(g)
 }
@@ -0,0 +1,169 @@
+// +build js
+
+package main
+
+import (
+	"go/ast"
+	"sort"
+	"strconv"
+
+	"github.com/gopherjs/gopherjs/compiler"
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// importPaths returns the sorted import paths of files, which the
+// compiler needs archives for.
+func importPaths(files []*ast.File) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, f := range files {
+		for _, spec := range f.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil || path == "unsafe" || seen[path] {
+				continue
+			}
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// progress is reported by prefetch each time a package has been loaded
+// or has failed to.
+type progress struct {
+	Path     string // the package
+	Size     int    // bytes read for Path
+	Bytes    int    // bytes read so far
+	Packages int    // packages loaded or failed so far
+	Total    int    // packages known to be needed so far
+}
+
+func (p progress) object() js.M {
+	return js.M{
+		"path":     p.Path,
+		"size":     p.Size,
+		"bytes":    p.Bytes,
+		"packages": p.Packages,
+		"total":    p.Total,
+	}
+}
+
+// prefetch loads the archives of paths, the runtime and everything they
+// import. Archives are fetched in parallel; the imports of each archive
+// are fetched as soon as it arrives. If report is not nil, it is called
+// as each archive is loaded. If canceled is closed, prefetch returns
+// errCanceled, leaving the fetches in flight to complete in the
+// background. from is the package compiled from the module proxy that
+// imports paths, if any. A failure to load is an *importChainError.
+// Which one is returned does not depend on which fetch failed first:
+// failures of the runtime and paths come first, in order, then those
+// of the other imports by path.
+func (c *packageCache) prefetch(from string, paths []string, report func(progress), canceled <-chan struct{}) error {
+	type loaded struct {
+		path    string
+		archive *compiler.Archive
+		size    int
+		err     error
+	}
+	results := make(chan loaded)
+	importer := make(map[string]string)
+	seen := make(map[string]bool)
+	inflight := 0
+	start := func(path, from string) {
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		if from != "" {
+			importer[path] = from
+		}
+		inflight++
+		go func() {
+			a, size, err := c.get(path, from)
+			results <- loaded{path, a, size, err}
+		}()
+	}
+	start("runtime", "")
+	for _, path := range paths {
+		start(path, "")
+	}
+	errs := make(map[string]error)
+	var p progress
+	for ; inflight > 0; inflight-- {
+		var l loaded
+		select {
+		case l = <-results:
+		case <-canceled:
+			go func(n int) {
+				for ; n > 0; n-- {
+					<-results
+				}
+			}(inflight)
+			return errCanceled
+		}
+		if l.err == nil {
+			for _, imp := range l.archive.Imports {
+				start(imp, l.path)
+			}
+		} else {
+			errs[l.path] = l.err
+		}
+		if report != nil {
+			p.Path, p.Size = l.path, l.size
+			p.Bytes += l.size
+			p.Packages++
+			p.Total = len(seen)
+			report(p)
+		}
+	}
+	order := append([]string{"runtime"}, paths...)
+	var rest []string
+	for path := range errs {
+		rest = append(rest, path)
+	}
+	sort.Strings(rest)
+	for _, path := range append(order, rest...) {
+		if err := errs[path]; err != nil {
+			chain := []string{path}
+			for p, ok := importer[path]; ok; p, ok = importer[p] {
+				chain = append([]string{p}, chain...)
+			}
+			// A package compiled from a module proxy fails with the
+			// chain of its own imports.
+			if e, ok := err.(*importChainError); ok {
+				chain, err = append(chain, e.chain...), e.err
+			}
+			return &importChainError{chain: chain, err: err}
+		}
+	}
+	return nil
+}
+
+// importDiagnostics returns the diagnostics for err, a failure to load
+// the imports of files, positioned at the import specs it concerns.
+func (r *request) importDiagnostics(files []*ast.File, err error) []diagnostic {
+	d := diagnose(err, codeImport, r.files)
+	e, ok := err.(*importChainError)
+	if !ok || len(d) != 1 || d[0].File != "" {
+		return d
+	}
+	var list []diagnostic
+	for _, f := range files {
+		for _, spec := range f.Imports {
+			if path, _ := strconv.Unquote(spec.Path.Value); path != e.chain[0] {
+				continue
+			}
+			start, end := r.fileSet.Position(spec.Path.Pos()), r.fileSet.Position(spec.Path.End())
+			p := d[0]
+			p.File, p.Line, p.Column = start.Filename, start.Line, start.Column
+			p.EndLine, p.EndColumn = end.Line, end.Column
+			list = append(list, p)
+		}
+	}
+	if len(list) == 0 {
+		return d
+	}
+	return list
+}
@@ -0,0 +1,242 @@
+// +build js
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/ast"
+	"go/scanner"
+	"go/types"
+	"path"
+	"strings"
+
+	"github.com/gopherjs/gopherjs/compiler"
+)
+
+// defaultModule is the module path of a request whose go.mod has none,
+// or without one, that of the multi-package examples of the Go
+// playground.
+const defaultModule = "play.ground"
+
+// localPackage is a package compiled from the files of a request in a
+// directory below that of package main. Its import path is the module
+// path followed by the directory.
+type localPackage struct {
+	path  string
+	files []*ast.File
+	// hash is of its sources and of the hashes of the local packages
+	// it imports, so it changes when they change.
+	hash string
+}
+
+// localPackages are the local packages of a request, in dependency
+// order.
+type localPackages []*localPackage
+
+// packageDir returns the directory of the file name, "." being that of
+// package main.
+func packageDir(name string) string {
+	return path.Dir(path.Clean(name))
+}
+
+// localPackages returns the packages of dirs, the files of r by
+// directory, that package main imports, directly or not.
+func (r *request) localPackages(dirs map[string][]*ast.File) (localPackages, error) {
+	module := defaultModule
+	if r.mod != nil && r.mod.module != "" {
+		module = r.mod.module
+	}
+	byPath := make(map[string]string)
+	for dir := range dirs {
+		if dir != "." {
+			byPath[module+"/"+dir] = dir
+		}
+	}
+	// A module replaced by a directory has the packages below it.
+	for old, repl := range r.mod.dirs() {
+		if repl.Dir == ".." || strings.HasPrefix(repl.Dir, "../") {
+			return nil, &scanner.Error{Pos: linePosition("go.mod", r.files["go.mod"], repl.line), Msg: "replacement directory " + repl.Dir + " is outside the files"}
+		}
+		for dir := range dirs {
+			switch {
+			case dir == repl.Dir:
+				byPath[old] = dir
+			case strings.HasPrefix(dir, repl.Dir+"/"):
+				byPath[old+strings.TrimPrefix(dir, repl.Dir)] = dir
+			}
+		}
+	}
+	var pkgs localPackages
+	hashes := make(map[string]string)
+	visiting := make(map[string]bool)
+	var stack []string
+	var visit func(path string) error
+	visit = func(path string) error {
+		if visiting[path] {
+			return fmt.Errorf("import cycle not allowed: %s", strings.Join(append(stack, path), " -> "))
+		}
+		if _, ok := hashes[path]; ok {
+			return nil
+		}
+		files := dirs[byPath[path]]
+		if files[0].Name.Name == "main" {
+			return fmt.Errorf("import %q is a program, not an importable package", path)
+		}
+		visiting[path] = true
+		stack = append(stack, path)
+		h := sha256.New()
+		for _, f := range files {
+			name := r.fileSet.File(f.Pos()).Name()
+			fmt.Fprintf(h, "file %q %d\n", name, len(r.files[name]))
+			h.Write(r.files[name])
+		}
+		for _, imp := range importPaths(files) {
+			if _, ok := byPath[imp]; !ok {
+				continue
+			}
+			if err := visit(imp); err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "import %q %s\n", imp, hashes[imp])
+		}
+		stack = stack[:len(stack)-1]
+		delete(visiting, path)
+		hashes[path] = hex.EncodeToString(h.Sum(nil))
+		pkgs = append(pkgs, &localPackage{path: path, files: files, hash: hashes[path]})
+		return nil
+	}
+	for _, imp := range importPaths(dirs["."]) {
+		if _, ok := byPath[imp]; !ok {
+			continue
+		}
+		if err := visit(imp); err != nil {
+			return nil, err
+		}
+	}
+	return pkgs, nil
+}
+
+// files returns main, the files of package main, and those of l.
+func (l localPackages) files(main []*ast.File) []*ast.File {
+	files := append([]*ast.File(nil), main...)
+	for _, p := range l {
+		files = append(files, p.files...)
+	}
+	return files
+}
+
+// imports returns the sorted paths of the archives that main and l
+// import, which are not local.
+func (l localPackages) imports(main []*ast.File) []string {
+	local := make(map[string]bool)
+	for _, p := range l {
+		local[p.path] = true
+	}
+	var paths []string
+	for _, path := range importPaths(l.files(main)) {
+		if !local[path] {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// compileLocal compiles the packages of l, unless the cache has their
+// archives from the same sources, and returns the import context of r:
+// that of the cache with the archives and types of l added, which other
+// requests do not see. The caller holds check.
+func (r *request) compileLocal(l localPackages) (*compiler.ImportContext, error) {
+	archives := make(map[string]*compiler.Archive, len(l))
+	importContext := r.importer(archives)
+	for _, p := range l {
+		if r.cache.fetched(p.path) {
+			return nil, fmt.Errorf("local package %s has the import path of a package archive", p.path)
+		}
+		if la, ok := r.cache.localArchive(p.path, p.hash); ok {
+			archives[p.path] = la.archive
+			importContext.Packages[p.path] = la.types
+			continue
+		}
+		a, err := compiler.Compile(p.path, p.files, r.fileSet, importContext, false)
+		if err != nil {
+			return nil, err
+		}
+		archives[p.path] = a
+		r.cache.addLocal(p.path, &localArchive{hash: p.hash, archive: a, types: importContext.Packages[p.path]})
+	}
+	return importContext, nil
+}
+
+// localArchive is the archive of a local package compiled by an earlier
+// request, with its types.
+type localArchive struct {
+	hash    string // of the sources, as in localPackage
+	archive *compiler.Archive
+	types   *types.Package
+}
+
+// localArchive returns the archive of the local package path compiled
+// from the sources of hash, if the cache has it.
+func (c *packageCache) localArchive(path, hash string) (*localArchive, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	la, ok := c.local[path]
+	return la, ok && la.hash == hash
+}
+
+// addLocal keeps la, the archive of the local package path, for the next
+// request compiling it from the same sources. The caller holds check.
+func (c *packageCache) addLocal(path string, la *localArchive) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.local[path] = la
+}
+
+// fetched reports whether the archive of path was read from the source.
+func (c *packageCache) fetched(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.archives[path]
+	_, compiled := c.compiled[path]
+	return ok && !compiled
+}
+
+// dropCompiled drops the archive of path compiled from the module proxy,
+// and its types, or that of the local package path, with the compiled
+// archives importing it, which refer to them. The caller holds check.
+func (c *packageCache) dropCompiled(path string) {
+	c.mu.Lock()
+	if _, ok := c.compiled[path]; ok {
+		delete(c.archives, path)
+		delete(c.compiled, path)
+		delete(c.packages, path)
+	}
+	delete(c.local, path)
+	var importers []string
+	for p := range c.compiled {
+		if imports(c.archives[p], path) {
+			importers = append(importers, p)
+		}
+	}
+	for p, la := range c.local {
+		if imports(la.archive, path) {
+			importers = append(importers, p)
+		}
+	}
+	c.mu.Unlock()
+	for _, p := range importers {
+		c.dropCompiled(p)
+	}
+}
+
+// imports reports whether a imports path.
+func imports(a *compiler.Archive, path string) bool {
+	for _, imp := range a.Imports {
+		if imp == path {
+			return true
+		}
+	}
+	return false
+}
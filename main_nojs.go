@@ -0,0 +1,15 @@
+// +build !js
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// main reports that jsplayground runs only when built with GopherJS; the
+// files without the js tag hold what can be tested with go test.
+func main() {
+	fmt.Fprintln(os.Stderr, "jsplayground must be built with GopherJS")
+	os.Exit(1)
+}
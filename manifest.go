@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/gopherjs/gopherjs/compiler"
+)
+
+// manifestFile describes the archives of a package directory. It is
+// optional; without it archives are not verified.
+const manifestFile = "manifest.json"
+
+// manifest is the contents of manifestFile. The toolchain versions of an
+// archive default to those of the manifest.
+type manifest struct {
+	// Version identifies the set of archives.
+	Version         string                   `json:"version"`
+	GoVersion       string                   `json:"goVersion"`
+	CompilerVersion string                   `json:"compilerVersion"`
+	Archives        map[string]manifestEntry `json:"archives"`
+}
+
+// manifestEntry describes the archive of a package.
+type manifestEntry struct {
+	SHA256          string `json:"sha256"`
+	Size            int64  `json:"size"`
+	GoVersion       string `json:"goVersion"`
+	CompilerVersion string `json:"compilerVersion"`
+	// Module is the module@version the package is of, if it is not of
+	// the standard library.
+	Module string `json:"module"`
+}
+
+// readManifest reads the manifest of source, returning nil if it has
+// none.
+func readManifest(source PackageSource) (*manifest, error) {
+	b, err := readFile(source, manifestFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := new(manifest)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, &corruptManifestError{err: err}
+	}
+	return m, nil
+}
+
+// check returns an error if the archive of path was built by another
+// toolchain than the one compiling. Go versions must agree on the
+// release, goX.Y; compiler versions must be equal.
+func (m *manifest) check(path string) error {
+	if m == nil {
+		return nil
+	}
+	e, ok := m.Archives[path]
+	if !ok {
+		return nil
+	}
+	goVersion, compilerVersion := e.GoVersion, e.CompilerVersion
+	if goVersion == "" {
+		goVersion = m.GoVersion
+	}
+	if compilerVersion == "" {
+		compilerVersion = m.CompilerVersion
+	}
+	if compilerVersion != "" && compilerVersion != compiler.Version {
+		return &versionMismatchError{path: path, reason: fmt.Sprintf("built by GopherJS %s, compiling with GopherJS %s", compilerVersion, compiler.Version)}
+	}
+	if goVersion != "" && release(goVersion) != release(runtime.Version()) {
+		return &versionMismatchError{path: path, reason: fmt.Sprintf("built for %s, compiling for %s", goVersion, runtime.Version())}
+	}
+	return nil
+}
+
+// checkVersion returns a *versionConflictError if the archive of path
+// is of another version of its module than v pins it to.
+func (m *manifest) checkVersion(path string, v versions) error {
+	if m == nil {
+		return nil
+	}
+	e, ok := m.Archives[path]
+	if !ok || e.Module == "" {
+		return nil
+	}
+	module, mv, ok := v.lookup(path)
+	if !ok || mv.String() == e.Module {
+		return nil
+	}
+	return &versionConflictError{module: module, msg: fmt.Sprintf("archive for package %q is of %s, not %s", path, e.Module, mv)}
+}
+
+// verify returns an error if b is not the archive of path the manifest
+// describes.
+func (m *manifest) verify(path string, b []byte) error {
+	if m == nil {
+		return nil
+	}
+	e, ok := m.Archives[path]
+	if !ok {
+		return nil
+	}
+	if e.Size != 0 && int64(len(b)) != e.Size {
+		return &corruptArchiveError{path: path, err: fmt.Errorf("size is %d, manifest has %d", len(b), e.Size)}
+	}
+	if e.SHA256 != "" {
+		if got := checksum(b); !strings.EqualFold(got, e.SHA256) {
+			return &corruptArchiveError{path: path, err: fmt.Errorf("sha256 is %s, manifest has %s", got, e.SHA256)}
+		}
+	}
+	return nil
+}
+
+// checksum returns the hex encoded SHA-256 of b.
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// release returns the goX.Y prefix of a Go version such as go1.12.9.
+func release(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/gopherjs/gopherjs/compiler"
+)
+
+func TestRelease(t *testing.T) {
+	for in, out := range map[string]string{
+		"go1.12.9":    "go1.12",
+		"go1.12":      "go1.12",
+		"go1.21rc2":   "go1.21rc2",
+		"go1.9.7.1":   "go1.9",
+		"devel +abcd": "devel +abcd",
+	} {
+		if got := release(in); got != out {
+			t.Errorf("release(%q) = %q, want %q", in, got, out)
+		}
+	}
+}
+
+func TestManifestCheck(t *testing.T) {
+	goVersion := release(runtime.Version()) + ".99"
+	m := &manifest{
+		GoVersion:       goVersion,
+		CompilerVersion: compiler.Version,
+		Archives: map[string]manifestEntry{
+			"fmt":          {},
+			"os":           {CompilerVersion: "0.0-other"},
+			"strings":      {GoVersion: "go1.0"},
+			"example.com/": {GoVersion: goVersion, CompilerVersion: compiler.Version},
+		},
+	}
+	old := &manifest{GoVersion: "go1.0", CompilerVersion: "0.0-other", Archives: map[string]manifestEntry{
+		"fmt": {},
+		"os":  {GoVersion: goVersion, CompilerVersion: compiler.Version},
+	}}
+	for _, test := range []struct {
+		m        *manifest
+		path     string
+		mismatch bool
+	}{
+		{nil, "fmt", false},
+		{m, "fmt", false},
+		{m, "os", true},
+		{m, "strings", true},
+		{m, "example.com/", false},
+		{m, "unlisted", false},
+		{old, "fmt", true},
+		{old, "os", false},
+	} {
+		err := test.m.check(test.path)
+		if _, ok := err.(*versionMismatchError); ok != test.mismatch {
+			t.Errorf("%s: got %v, want mismatch %v", test.path, err, test.mismatch)
+		}
+	}
+}
+
+func TestManifestVerify(t *testing.T) {
+	b := []byte("archive")
+	sum := checksum(b)
+	m := &manifest{Archives: map[string]manifestEntry{
+		"sized":   {Size: int64(len(b))},
+		"summed":  {SHA256: sum},
+		"upper":   {SHA256: strings.ToUpper(sum), Size: int64(len(b))},
+		"short":   {Size: int64(len(b)) + 1},
+		"altered": {SHA256: checksum([]byte("other"))},
+		"empty":   {},
+	}}
+	for _, test := range []struct {
+		m       *manifest
+		path    string
+		corrupt bool
+	}{
+		{nil, "sized", false},
+		{m, "sized", false},
+		{m, "summed", false},
+		{m, "upper", false},
+		{m, "short", true},
+		{m, "altered", true},
+		{m, "empty", false},
+		{m, "unlisted", false},
+	} {
+		err := test.m.verify(test.path, b)
+		if _, ok := err.(*corruptArchiveError); ok != test.corrupt {
+			t.Errorf("%s: got %v, want corrupt %v", test.path, err, test.corrupt)
+		}
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	m, err := readManifest(memorySource{})
+	if m != nil || err != nil {
+		t.Errorf("without a manifest: got %v, %v, want nil, nil", m, err)
+	}
+	m, err = readManifest(memorySource{manifestFile: []byte(`{"version": "1", "archives": {"fmt": {"size": 3}}}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != "1" || m.Archives["fmt"].Size != 3 {
+		t.Errorf("got %+v", m)
+	}
+	_, err = readManifest(memorySource{manifestFile: []byte(`{"version": `)})
+	if _, ok := err.(*corruptManifestError); !ok {
+		t.Errorf("unparsable manifest: got %v, want a corrupt manifest", err)
+	}
+	if transient(err) {
+		t.Errorf("%v is transient", err)
+	}
+}
+
+func TestManifestCheckVersion(t *testing.T) {
+	m := &manifest{Archives: map[string]manifestEntry{
+		"example.com/a/pkg": {Module: "example.com/a@v1.0.0"},
+		"example.com/b":     {Module: "example.com/b@v1.0.0"},
+		"fmt":               {},
+	}}
+	v := versions{
+		"example.com/a": {Path: "example.com/a", Version: "v1.0.0"},
+		"example.com/b": {Path: "example.com/b", Version: "v1.1.0"},
+	}
+	for path, module := range map[string]string{
+		"example.com/a/pkg": "",
+		"example.com/b":     "example.com/b",
+		"fmt":               "",
+		"example.com/c":     "",
+	} {
+		err := m.checkVersion(path, v)
+		e, ok := err.(*versionConflictError)
+		if ok != (module != "") || ok && e.module != module {
+			t.Errorf("%s: got %v, want a conflict of module %q", path, err, module)
+		}
+	}
+	if err := m.checkVersion("example.com/b", nil); err != nil {
+		t.Errorf("without versions: got %v", err)
+	}
+
+	gomod := []byte("module m\n\nrequire (\n\texample.com/a v1.0.0\n\texample.com/b v1.1.0\n)\n")
+	for _, test := range []struct {
+		e    *versionConflictError
+		line int
+	}{
+		{&versionConflictError{module: "example.com/b"}, 5},
+		{&versionConflictError{line: 4, module: "example.com/b"}, 4},
+		{&versionConflictError{module: "example.com/c"}, 0},
+		{&versionConflictError{}, 0},
+	} {
+		if line := test.e.requirement(gomod); line != test.line {
+			t.Errorf("%+v: got line %d, want %d", test.e, line, test.line)
+		}
+	}
+	if line := (&versionConflictError{module: "example.com/b"}).requirement(nil); line != 0 {
+		t.Errorf("without go.mod: got line %d", line)
+	}
+}
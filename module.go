@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// moduleProxy reads the sources of packages there are no archives for
+// from a Go module proxy, a PackageSource with the files of the GOPROXY
+// protocol: <module>/@latest, the latest version as {"Version": ...},
+// and <module>/@v/<version>.zip, the module's files below
+// <module>@<version>/, paths and versions escaped.
+type moduleProxy struct {
+	source PackageSource
+
+	mu    sync.Mutex // guards reads
+	reads map[string]*proxyRead
+}
+
+// proxyRead is a file read from the proxy. Reads of a file being read
+// wait for it; failed reads are not remembered.
+type proxyRead struct {
+	done chan struct{}
+	b    []byte
+	err  error
+}
+
+func newModuleProxy(source PackageSource) *moduleProxy {
+	return &moduleProxy{source: source, reads: make(map[string]*proxyRead)}
+}
+
+// read returns the file name of the proxy, reading it once.
+func (p *moduleProxy) read(name string) ([]byte, error) {
+	p.mu.Lock()
+	r, ok := p.reads[name]
+	if ok {
+		p.mu.Unlock()
+		<-r.done
+		return r.b, r.err
+	}
+	r = &proxyRead{done: make(chan struct{})}
+	p.reads[name] = r
+	p.mu.Unlock()
+	r.b, r.err = readFile(p.source, name)
+	if r.err != nil {
+		p.mu.Lock()
+		delete(p.reads, name)
+		p.mu.Unlock()
+	}
+	close(r.done)
+	return r.b, r.err
+}
+
+// module returns the module providing the package pkg and the version
+// of it to read: the one v pins it to, or else the latest version of
+// the longest prefix of pkg the proxy has.
+func (p *moduleProxy) module(pkg string, v versions) (module string, mv moduleVersion, err error) {
+	if module, mv, ok := v.lookup(pkg); ok {
+		return module, mv, nil
+	}
+	for module = pkg; module != "."; module = path.Dir(module) {
+		b, err := p.read(escapeModule(module) + "/@latest")
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", mv, err
+		}
+		var info struct{ Version string }
+		if err := json.Unmarshal(b, &info); err != nil || info.Version == "" {
+			return "", mv, fmt.Errorf("bad latest version of module %s", module)
+		}
+		return module, moduleVersion{Path: module, Version: info.Version}, nil
+	}
+	return "", mv, &os.PathError{Op: "find module", Path: pkg, Err: os.ErrNotExist}
+}
+
+// importCycle returns the imports from -> path -> ... -> from if the
+// load of path waits, through those of its imports, for the compile of
+// from, waits holding the loads each compile waits for.
+func importCycle(waits map[string]map[string]int, from, path string) []string {
+	seen := make(map[string]bool)
+	var walk func(p string) []string
+	walk = func(p string) []string {
+		if p == from {
+			return []string{p}
+		}
+		if seen[p] {
+			return nil
+		}
+		seen[p] = true
+		for next := range waits[p] {
+			if rest := walk(next); rest != nil {
+				return append([]string{p}, rest...)
+			}
+		}
+		return nil
+	}
+	if rest := walk(path); rest != nil {
+		return append([]string{from}, rest...)
+	}
+	return nil
+}
+
+// moduleFiles returns the Go files of the package in the directory dir
+// of b, the zip of mv, that GopherJS builds, by name. It fails with an
+// error satisfying os.IsNotExist if there are none.
+func moduleFiles(b []byte, mv moduleVersion, dir string) (map[string][]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, fmt.Errorf("module %s: %v", mv, err)
+	}
+	prefix := mv.String() + dir + "/"
+	files := make(map[string][]byte)
+	for _, f := range zr.File {
+		name := strings.TrimPrefix(f.Name, prefix)
+		if name == f.Name || strings.Contains(name, "/") || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %v", mv, err)
+		}
+		files[name], err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %v", mv, err)
+		}
+	}
+	ctxt := buildContext(files)
+	for name := range files {
+		if ok, err := ctxt.MatchFile(".", name); err != nil || !ok {
+			delete(files, name)
+		}
+	}
+	if len(files) == 0 {
+		return nil, &os.PathError{Op: "open", Path: prefix, Err: os.ErrNotExist}
+	}
+	return files, nil
+}
+
+// buildContext returns the build context of GopherJS, reading files.
+// As in GopherJS, purego selects the Go fallbacks of packages with
+// assembly, which cannot be compiled.
+func buildContext(files map[string][]byte) *build.Context {
+	ctxt := build.Default
+	ctxt.GOOS, ctxt.GOARCH = "linux", "js"
+	ctxt.CgoEnabled = false
+	ctxt.BuildTags = []string{"netgo", "purego"}
+	ctxt.JoinPath = path.Join
+	ctxt.OpenFile = func(name string) (io.ReadCloser, error) {
+		b, ok := files[path.Base(name)]
+		if !ok {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	return &ctxt
+}
+
+// escapeModule escapes a module path or version for the proxy: each
+// upper case letter becomes an exclamation mark and the letter in lower
+// case.
+func escapeModule(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if 'A' <= r && r <= 'Z' {
+			b.WriteByte('!')
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// inModule reports whether path can be the path of a package in a
+// module, that is, its first element has a dot, unlike those of the
+// standard library.
+func inModule(path string) bool {
+	first := strings.SplitN(path, "/", 2)[0]
+	return strings.Contains(first, ".")
+}
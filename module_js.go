@@ -0,0 +1,143 @@
+// +build js
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gopherjs/gopherjs/compiler"
+)
+
+// moduleCache is the Cache Storage cache module zips, and the archives
+// compiled from them, are kept in. A version of a module never changes,
+// so they are never evicted.
+const moduleCache = "jsplayground:modules"
+
+// zip returns the zip of mv, read from moduleCache if it was stored
+// there.
+func (p *moduleProxy) zip(mv moduleVersion) ([]byte, error) {
+	name := escapeModule(mv.Path) + "/@v/" + escapeModule(mv.Version) + ".zip"
+	key := keyPrefix + "module/" + name
+	if b, ok := cacheGet(moduleCache, key); ok {
+		return b, nil
+	}
+	b, err := p.read(name)
+	if err != nil {
+		return nil, err
+	}
+	cachePut(moduleCache, key, b)
+	return b, nil
+}
+
+// packageFiles returns the Go files of the package in the directory dir
+// of mv that GopherJS builds, by name. It fails with an error
+// satisfying os.IsNotExist if there are none.
+func (p *moduleProxy) packageFiles(mv moduleVersion, dir string) (map[string][]byte, error) {
+	b, err := p.zip(mv)
+	if err != nil {
+		return nil, err
+	}
+	return moduleFiles(b, mv, dir)
+}
+
+// moduleSources are the sources of a package of a module version,
+// whose imports are loaded.
+type moduleSources struct {
+	path   string
+	mv     moduleVersion
+	fset   *token.FileSet
+	files  []*ast.File
+	key    string // of the archive in moduleCache
+	stored []byte // the archive kept in moduleCache, if it was
+}
+
+// moduleSources returns the sources of the package path from its module
+// on proxy, at the version v pins it to or else the latest, loading the
+// archives they import, and the number of bytes of them. notFound is
+// returned if the proxy does not have the package.
+func (c *packageCache) moduleSources(proxy *moduleProxy, path string, v versions, notFound error) (s *moduleSources, size int, retry bool, err error) {
+	module, mv, err := proxy.module(path, v)
+	dir := strings.TrimPrefix(path, module)
+	var sources map[string][]byte
+	switch {
+	case err == nil && mv.Dir != "":
+		// A package of a module replaced by a directory is local.
+		return nil, 0, false, notFound
+	case err == nil:
+		sources, err = proxy.packageFiles(mv, dir)
+	}
+	switch {
+	case os.IsNotExist(err):
+		return nil, 0, false, notFound
+	case err != nil:
+		return nil, 0, transient(err), &networkError{path: path, err: err}
+	}
+	names := make([]string, 0, len(sources))
+	for name, b := range sources {
+		names = append(names, name)
+		size += len(b)
+	}
+	sort.Strings(names)
+	s = &moduleSources{path: path, mv: mv, fset: token.NewFileSet()}
+	for _, name := range names {
+		f, err := parser.ParseFile(s.fset, mv.String()+dir+"/"+name, sources[name], parser.ParseComments)
+		if err != nil {
+			return nil, size, false, err
+		}
+		s.files = append(s.files, f)
+	}
+	imports := importPaths(s.files)
+	if err := c.prefetch(path, imports, nil, nil); err != nil {
+		return nil, size, false, err
+	}
+	s.key = c.archiveKey(mv, path, imports)
+	s.stored, _ = cacheGet(moduleCache, s.key)
+	return s, size, false, nil
+}
+
+// compileModule returns the archive of s, read from moduleCache if it
+// was kept there, or else compiled, in which case fresh is set and the
+// caller keeps it with keep. The caller holds check.
+func (c *packageCache) compileModule(s *moduleSources) (a *compiler.Archive, fresh bool, err error) {
+	if s.stored != nil {
+		a, err = compiler.ReadArchive(s.path+".a", s.path, bytes.NewReader(s.stored), c.packages)
+		if err == nil {
+			return a, false, nil
+		}
+	}
+	a, err = compiler.Compile(s.path, s.files, s.fset, &compiler.ImportContext{Packages: c.packages, Import: c.lookup}, false)
+	if err != nil {
+		return nil, false, fmt.Errorf("compiling %s: %v", s.mv, err)
+	}
+	return a, true, nil
+}
+
+// keep stores a, the archive compiled from s, in moduleCache.
+func (s *moduleSources) keep(a *compiler.Archive) {
+	var buf bytes.Buffer
+	if err := compiler.WriteArchive(a, &buf); err == nil {
+		cachePut(moduleCache, s.key, buf.Bytes())
+	}
+}
+
+// archiveKey returns the key the archive of path, compiled from mv, is
+// kept under in moduleCache. The archive holds the types of the packages
+// it imports, so the key has the versions those were compiled from.
+func (c *packageCache) archiveKey(mv moduleVersion, path string, imports []string) string {
+	h := sha256.New()
+	c.mu.Lock()
+	for _, imp := range imports {
+		fmt.Fprintf(h, "import %q %s\n", imp, c.compiled[imp])
+	}
+	c.mu.Unlock()
+	return keyPrefix + "archive/" + compiler.Version + "/" + mv.String() + "/" + path + "/" + hex.EncodeToString(h.Sum(nil)) + ".a"
+}
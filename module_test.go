@@ -0,0 +1,172 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestEscapeModule(t *testing.T) {
+	for _, test := range []struct{ in, out string }{
+		{"example.com/m", "example.com/m"},
+		{"github.com/BurntSushi/toml", "github.com/!burnt!sushi/toml"},
+		{"v1.0.0-RC1", "v1.0.0-!r!c1"},
+	} {
+		if out := escapeModule(test.in); out != test.out {
+			t.Errorf("escapeModule(%q) = %q, want %q", test.in, out, test.out)
+		}
+	}
+}
+
+func TestInModule(t *testing.T) {
+	for path, want := range map[string]bool{
+		"fmt":                     false,
+		"encoding/json":           false,
+		"example.com":             true,
+		"golang.org/x/text/cases": true,
+	} {
+		if got := inModule(path); got != want {
+			t.Errorf("inModule(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestModuleProxy(t *testing.T) {
+	p := newModuleProxy(memorySource{
+		"example.com/m/@latest":      []byte(`{"Version": "v1.2.0"}`),
+		"example.com/!upper/@latest": []byte(`{"Version": "v0.1.0"}`),
+		"example.com/bad/@latest":    []byte(`{}`),
+		"example.com/m/v2/@latest":   []byte(`{"Version": "v2.0.1"}`),
+	})
+	pinned := versions{"example.com/m": {Path: "example.com/fork", Version: "v1.0.0"}}
+	for _, test := range []struct {
+		pkg    string
+		v      versions
+		module string
+		mv     moduleVersion
+	}{
+		{"example.com/m", nil, "example.com/m", moduleVersion{Path: "example.com/m", Version: "v1.2.0"}},
+		{"example.com/m/sub/pkg", nil, "example.com/m", moduleVersion{Path: "example.com/m", Version: "v1.2.0"}},
+		{"example.com/m/v2/pkg", nil, "example.com/m/v2", moduleVersion{Path: "example.com/m/v2", Version: "v2.0.1"}},
+		{"example.com/Upper", nil, "example.com/Upper", moduleVersion{Path: "example.com/Upper", Version: "v0.1.0"}},
+		{"example.com/m/sub", pinned, "example.com/m", moduleVersion{Path: "example.com/fork", Version: "v1.0.0"}},
+	} {
+		module, mv, err := p.module(test.pkg, test.v)
+		if err != nil {
+			t.Errorf("%s: %v", test.pkg, err)
+			continue
+		}
+		if module != test.module || mv != test.mv {
+			t.Errorf("%s: got %s at %v, want %s at %v", test.pkg, module, mv, test.module, test.mv)
+		}
+	}
+	if _, _, err := p.module("example.org/missing/pkg", nil); !os.IsNotExist(err) {
+		t.Errorf("missing module: got %v, want not exist", err)
+	}
+	if _, _, err := p.module("example.com/bad", nil); err == nil || os.IsNotExist(err) {
+		t.Errorf("bad latest version: got %v, want an error", err)
+	}
+}
+
+func TestModuleProxyRead(t *testing.T) {
+	source := memorySource{}
+	p := newModuleProxy(source)
+	if _, err := p.read("example.com/m/@latest"); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want not exist", err)
+	}
+	source["example.com/m/@latest"] = []byte(`{"Version": "v1.0.0"}`)
+	if _, err := p.read("example.com/m/@latest"); err != nil {
+		t.Fatalf("failure was remembered: %v", err)
+	}
+	delete(source, "example.com/m/@latest")
+	if _, err := p.read("example.com/m/@latest"); err != nil {
+		t.Fatalf("file read was not remembered: %v", err)
+	}
+}
+
+func TestModuleFiles(t *testing.T) {
+	mv := moduleVersion{Path: "example.com/m", Version: "v1.2.0"}
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range map[string]string{
+		"go.mod":          "module example.com/m\n",
+		"README.md":       "# m\n",
+		"m.go":            "package m\n",
+		"m_test.go":       "package m\n",
+		"net.go":          "//go:build netgo\n\npackage m\n",
+		"cgo.go":          "//go:build cgo\n\npackage m\n",
+		"fast_purego.go":  "//go:build purego\n\npackage m\n",
+		"fast_asm.go":     "//go:build !purego\n\npackage m\n",
+		"sys_js.go":       "package m\n",
+		"sys_wasm.go":     "package m\n",
+		"sys_windows.go":  "package m\n",
+		"sub/sub.go":      "package sub\n",
+		"sub/deep/d.go":   "package deep\n",
+		"docs/README.txt": "docs\n",
+	} {
+		f, err := w.Create(mv.String() + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		dir   string
+		files []string
+	}{
+		{"", []string{"fast_purego.go", "m.go", "net.go", "sys_js.go"}},
+		{"/sub", []string{"sub.go"}},
+		{"/sub/deep", []string{"d.go"}},
+	} {
+		files, err := moduleFiles(buf.Bytes(), mv, test.dir)
+		if err != nil {
+			t.Errorf("%q: %v", test.dir, err)
+			continue
+		}
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, test.files) {
+			t.Errorf("%q: got %v, want %v", test.dir, names, test.files)
+		}
+	}
+	for _, dir := range []string{"/docs", "/missing"} {
+		if _, err := moduleFiles(buf.Bytes(), mv, dir); !os.IsNotExist(err) {
+			t.Errorf("%q: got %v, want not exist", dir, err)
+		}
+	}
+	if _, err := moduleFiles([]byte("not a zip"), mv, ""); err == nil || os.IsNotExist(err) {
+		t.Errorf("corrupt zip: got %v, want an error", err)
+	}
+}
+
+func TestImportCycle(t *testing.T) {
+	waits := map[string]map[string]int{
+		"a": {"b": 1, "x": 1},
+		"b": {"c": 1},
+		"x": {"y": 1},
+	}
+	for _, test := range []struct {
+		from, path string
+		cycle      []string
+	}{
+		{"c", "a", []string{"c", "a", "b", "c"}},
+		{"b", "c", nil},
+		{"y", "x", []string{"y", "x", "y"}},
+		{"x", "y", nil},
+		{"a", "a", []string{"a", "a"}},
+		{"z", "a", nil},
+	} {
+		if cycle := importCycle(waits, test.from, test.path); !reflect.DeepEqual(cycle, test.cycle) {
+			t.Errorf("%s -> %s: got %v, want %v", test.from, test.path, cycle, test.cycle)
+		}
+	}
+}
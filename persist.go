@@ -0,0 +1,236 @@
+// +build js
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// keyPrefix starts the URLs files are stored under in Cache Storage.
+const keyPrefix = "/jsplayground/"
+
+// cacheSource keeps the files read from source in the browser's Cache
+// Storage under the cache name, so they survive page loads and are
+// available offline.
+//
+// If source has a manifest, it is stored too, and used when source
+// cannot be reached. Archives the manifest lists are stored under their
+// SHA-256, so an archive that is the same in two versions of the
+// archive set is fetched once; other files are stored under the version.
+// When the version changes, files the new version does not have are
+// evicted. Without a manifest, files are stored by name and never
+// evicted, unless versioned is set, in which case they are not stored.
+type cacheSource struct {
+	name      string
+	source    PackageSource
+	versioned bool
+
+	mu       sync.Mutex // guards the fields below
+	manifest *manifest
+	read     bool // whether manifest has been read
+}
+
+func (s *cacheSource) ReadFile(name string) ([]byte, error) {
+	if name == manifestFile {
+		return s.readManifest()
+	}
+	key, sum := s.key(s.currentManifest(), name)
+	if key == "" {
+		return s.source.ReadFile(name)
+	}
+	if b, ok := cacheGet(s.name, key); ok {
+		return b, nil
+	}
+	b, err := s.source.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	// An archive that does not match is refused by the loader; keep it
+	// out of the cache so that it is fetched again.
+	if sum == "" || checksum(b) == sum {
+		cachePut(s.name, key, b)
+	}
+	return b, nil
+}
+
+// key returns the key the file name is stored under given the manifest
+// m, and its SHA-256 if the manifest lists it. It returns "" if the
+// file is not to be stored.
+func (s *cacheSource) key(m *manifest, name string) (key, sum string) {
+	switch {
+	case m != nil:
+		if e := m.Archives[strings.TrimSuffix(name, ".a")]; strings.HasSuffix(name, ".a") && e.SHA256 != "" {
+			sum = strings.ToLower(e.SHA256)
+			return keyPrefix + "sha256/" + sum, sum
+		}
+		return keyPrefix + "version/" + m.Version + "/" + name, ""
+	case s.versioned:
+		return "", ""
+	}
+	return keyPrefix + "pkg/" + name, ""
+}
+
+// currentManifest returns the manifest of source, reading it if it has
+// not been read.
+func (s *cacheSource) currentManifest() *manifest {
+	s.mu.Lock()
+	m, read := s.manifest, s.read
+	s.mu.Unlock()
+	if read {
+		return m
+	}
+	s.readManifest()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.manifest
+}
+
+// readManifest reads the manifest from source, storing it and evicting
+// files of other versions, or, if source cannot be reached, returns the
+// stored manifest.
+func (s *cacheSource) readManifest() ([]byte, error) {
+	key := keyPrefix + manifestFile
+	b, err := s.source.ReadFile(manifestFile)
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		s.setManifest(nil)
+		return nil, err
+	default:
+		stored, ok := cacheGet(s.name, key)
+		if !ok {
+			return nil, err
+		}
+		b = stored
+	}
+	m := new(manifest)
+	if err := json.Unmarshal(b, m); err != nil {
+		// The loader reports the error; files are stored by name
+		// until the manifest parses.
+		s.setManifest(nil)
+		return b, nil
+	}
+	s.setManifest(m)
+	if stored, ok := cacheGet(s.name, key); !ok || !sameVersion(stored, m) {
+		cachePut(s.name, key, b)
+		s.evict(m)
+	}
+	return b, nil
+}
+
+func (s *cacheSource) setManifest(m *manifest) {
+	s.mu.Lock()
+	s.manifest, s.read = m, true
+	s.mu.Unlock()
+}
+
+// sameVersion reports whether the manifest b has the version of m.
+func sameVersion(b []byte, m *manifest) bool {
+	var old manifest
+	return json.Unmarshal(b, &old) == nil && old.Version == m.Version
+}
+
+// evict deletes the stored files that version m of the archive set does
+// not have.
+func (s *cacheSource) evict(m *manifest) {
+	keep := map[string]bool{keyPrefix + manifestFile: true}
+	for _, e := range m.Archives {
+		if e.SHA256 != "" {
+			keep[keyPrefix+"sha256/"+strings.ToLower(e.SHA256)] = true
+		}
+	}
+	current := keyPrefix + "version/" + m.Version + "/"
+	cache := openCache(s.name)
+	if cache == nil {
+		return
+	}
+	requests, err := await(cache.Call("keys"))
+	if err != nil {
+		return
+	}
+	for i := 0; i < requests.Length(); i++ {
+		url := requests.Index(i).Get("url").String()
+		j := strings.Index(url, keyPrefix)
+		if j == -1 {
+			continue
+		}
+		if key := url[j:]; !keep[key] && !strings.HasPrefix(key, current) {
+			await(cache.Call("delete", requests.Index(i)))
+		}
+	}
+}
+
+func (s *cacheSource) forget(name string) {
+	if f, ok := s.source.(forgetter); ok {
+		f.forget(name)
+	}
+	if name == "" {
+		if storage := cacheStorage(); storage != nil {
+			await(storage.Call("delete", s.name))
+		}
+		s.mu.Lock()
+		s.manifest, s.read = nil, false
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Lock()
+	m := s.manifest
+	s.mu.Unlock()
+	if key, _ := s.key(m, name); key != "" {
+		if cache := openCache(s.name); cache != nil {
+			await(cache.Call("delete", key))
+		}
+	}
+}
+
+// cacheStorage returns the browser's Cache Storage, or nil if there is
+// none, as outside secure contexts.
+func cacheStorage() *js.Object {
+	storage := js.Global.Get("caches")
+	if storage == js.Undefined {
+		return nil
+	}
+	return storage
+}
+
+// openCache returns the cache name, or nil if it cannot be opened.
+func openCache(name string) *js.Object {
+	storage := cacheStorage()
+	if storage == nil {
+		return nil
+	}
+	cache, err := await(storage.Call("open", name))
+	if err != nil {
+		return nil
+	}
+	return cache
+}
+
+func cacheGet(name, key string) ([]byte, bool) {
+	cache := openCache(name)
+	if cache == nil {
+		return nil, false
+	}
+	res, err := await(cache.Call("match", key))
+	if err != nil || res == js.Undefined {
+		return nil, false
+	}
+	buf, err := await(res.Call("arrayBuffer"))
+	if err != nil {
+		return nil, false
+	}
+	return bytesOf(buf), true
+}
+
+// cachePut stores b. Failing to is not an error; the file is read from
+// the source again next time.
+func cachePut(name, key string, b []byte) {
+	if cache := openCache(name); cache != nil {
+		await(cache.Call("put", key, js.Global.Get("Response").New(js.NewArrayBuffer(b))))
+	}
+}
@@ -0,0 +1,548 @@
+// +build js
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// runPrelude is run in the worker before the program. It stands in for
+// the syscall module GopherJS requires under Node.js: reads of stdin,
+// writes to stdout and stderr and exits go to the page, file system
+// calls to goFS, and other system calls fail with ENOSYS. println, which
+// GopherJS writes with console.log, goes to stderr as it does in Go.
+//
+// The program starts when the page posts {type: "start", stdin, shared,
+// virtualTime, files}, files being added to goFS, stdin the input given
+// up front, a Uint8Array, and shared the SharedArrayBuffer interactive
+// input is passed in, if any; see input.shared. If virtualTime is set,
+// the program runs on a virtual clock starting at that time, in
+// milliseconds since 1970. The worker posts {type: "output", fd, data,
+// time}, where data is a Uint8Array and time the virtual time in
+// milliseconds, if any, and {type: "read"} when it waits for input, then
+// {type: "files", files}, the files of goFS, and one of {type: "exit",
+// status} or {type: "panic", message, stack}, after which it posts
+// nothing.
+const runPrelude = `var goExited = false;
+(function() {
+  var encoder = new TextEncoder();
+  var exitError = new Error("exit");
+  var start = null;
+  var stdin = {data: new Uint8Array(0), offset: 0, state: null, buf: null};
+  var clock = null;
+  var post = function(message, transfer) {
+    if (!goExited) {
+      postMessage(message, transfer || []);
+    }
+  };
+  var write = function(fd, b) {
+    var chunk = new Uint8Array(b);
+    post({type: "output", fd: fd, data: chunk, time: clock ? clock.now : undefined}, [chunk.buffer]);
+  };
+  /* virtualTime replaces the clock and timers, which GopherJS reads
+     through Date and setTimeout, with a virtual clock starting at now.
+     Timers run in order of expiry, the clock jumping to each, so the
+     program runs without waiting. */
+  var virtualTime = function(now) {
+    var RealDate = Date;
+    var timers = [];
+    var lastID = 0;
+    var pumping = false;
+    var channel = new MessageChannel();
+    clock = {now: now};
+    var schedule = function() {
+      if (timers.length > 0 && !pumping) {
+        pumping = true;
+        channel.port2.postMessage(null);
+      }
+    };
+    /* pump runs timers for a while, then lets the worker handle events. */
+    channel.port1.onmessage = function() {
+      pumping = false;
+      var deadline = RealDate.now() + 10;
+      while (timers.length > 0 && !goExited && RealDate.now() < deadline) {
+        var t = timers.shift();
+        if (t.when > clock.now) {
+          clock.now = t.when;
+        }
+        t.f.apply(undefined, t.args);
+      }
+      schedule();
+    };
+    self.setTimeout = function(f, delay) {
+      var t = {id: ++lastID, when: clock.now + Math.max(0, delay | 0), f: f, args: Array.prototype.slice.call(arguments, 2)};
+      var i = timers.length;
+      while (i > 0 && timers[i - 1].when > t.when) {
+        i--;
+      }
+      timers.splice(i, 0, t);
+      schedule();
+      return t.id;
+    };
+    self.clearTimeout = function(id) {
+      timers = timers.filter(function(t) { return t.id !== id; });
+    };
+    self.Date = class extends RealDate {
+      constructor() {
+        if (arguments.length === 0) {
+          super(clock.now);
+        } else {
+          super(...arguments);
+        }
+      }
+      static now() {
+        return clock.now;
+      }
+    };
+  };
+  var postFiles = function() {
+    var files = goFS.files();
+    post({type: "files", files: files}, Object.keys(files).map(function(p) { return files[p].buffer; }));
+  };
+  self.goExit = function(status) {
+    postFiles();
+    post({type: "exit", status: status});
+    goExited = true;
+  };
+  /* goStart is passed the function starting the program, which it
+     calls once the page has sent the input. */
+  self.goStart = function(f) {
+    start = f;
+  };
+  self.addEventListener("message", function(e) {
+    if (e.data.type !== "start") {
+      return;
+    }
+    if (e.data.stdin) {
+      stdin.data = e.data.stdin;
+    }
+    if (e.data.shared) {
+      stdin.state = new Int32Array(e.data.shared, 0, 2);
+      stdin.buf = new Uint8Array(e.data.shared, 8);
+    }
+    if (e.data.virtualTime) {
+      virtualTime(e.data.virtualTime);
+    }
+    if (e.data.files) {
+      goFS.add(e.data.files);
+    }
+    start();
+  });
+  var read = function(b, n) {
+    if (stdin.offset === stdin.data.length && stdin.state !== null) {
+      post({type: "read"});
+      Atomics.wait(stdin.state, 0, 0);
+      var length = Atomics.load(stdin.state, 1);
+      Atomics.store(stdin.state, 0, 0);
+      if (length === -2) {
+        return [-1, 0, 5]; /* EIO */
+      }
+      if (length === -1) {
+        stdin.state = null;
+      } else {
+        stdin.data = stdin.buf.slice(0, length);
+        stdin.offset = 0;
+      }
+    }
+    var k = Math.min(n, stdin.data.length - stdin.offset);
+    b.set(stdin.data.subarray(stdin.offset, stdin.offset + k));
+    stdin.offset += k;
+    return [k, 0, 0];
+  };
+  /* goRunMain wraps the init function of the main package, which runs
+     main, to exit when it returns. */
+  self.goRunMain = function(f) {
+    return function() {
+      var r = f();
+      if (r && r.$blk !== undefined) {
+        return {$blk: goRunMain(function() { return r.$blk(); })};
+      }
+      goExit(0);
+    };
+  };
+  var syscall = function(trap, a1, a2, a3, a4, a5, a6) {
+    switch (trap) {
+    case 0: /* read */
+      if (a1 !== 0) {
+        break;
+      }
+      if (a3 === 0) {
+        return [0, 0, 0];
+      }
+      return read(a2, a3);
+    case 1: /* write */
+      if (a1 !== 1 && a1 !== 2) {
+        break;
+      }
+      if (a3 !== 0) {
+        write(a1, a2.subarray(0, a3));
+      }
+      return [a3, 0, 0];
+    case 60: /* exit */
+    case 231: /* exit_group */
+      goExit(a1);
+      throw exitError;
+    }
+    return goFS.syscall(trap, a1, a2, a3, a4, a5, a6);
+  };
+  self.require = function(name) {
+    if (name !== "syscall") {
+      throw new Error("cannot find module '" + name + "'");
+    }
+    return {Syscall: syscall, Syscall6: syscall};
+  };
+  var consoleError = console.error;
+  console.log = function() {
+    write(2, encoder.encode(Array.prototype.join.call(arguments, " ") + "\n"));
+  };
+  console.error = function(message) {
+    if (message === "fatal error: all goroutines are asleep - deadlock!") {
+      write(2, encoder.encode(message + "\n"));
+      goExit(2);
+      return;
+    }
+    consoleError.apply(console, arguments);
+  };
+  self.addEventListener("error", function(e) {
+    e.preventDefault();
+    var err = e.error;
+    if (!goExited) {
+      postFiles();
+    }
+    post({
+      type: "panic",
+      message: err && err.message !== undefined ? String(err.message) : String(e.message),
+      stack: err && err.stack ? String(err.stack) : ""
+    });
+    goExited = true;
+  });
+})();
+`
+
+// epoch is the time a program run on a virtual clock starts at, that of
+// the Go playground.
+var epoch = time.Date(2009, 11, 10, 23, 0, 0, 0, time.UTC)
+
+// mainCall starts the main package in the code the compiler writes. run
+// replaces it to start the program once the worker has its input, and to
+// learn when main returns.
+const mainCall = "$go($mainPkg.$init, []);"
+
+// Default limits of a run.
+const (
+	defaultTimeout     = 10 * time.Second
+	defaultOutputLimit = 1 << 20
+)
+
+// Limits that stop a run.
+const (
+	limitTimeout = "timeout"
+	limitOutput  = "output"
+)
+
+// runOptions are the settings Javascript may pass to Run, in addition to
+// those of Compile, as {stdin, stdout, stderr, onOutput, timeout,
+// outputLimit, virtualTime, files}.
+type runOptions struct {
+	// stdin is the standard input; see readInput.
+	stdin *input
+	// stdout and stderr are called with each write to the stream, as a
+	// Uint8Array the function may keep.
+	stdout, stderr *js.Object
+	// onOutput is called with the stream, "stdout" or "stderr", and the
+	// text of each write to it.
+	onOutput *js.Object
+	// timeout is how long the program may run for, set in
+	// milliseconds; 0 is no limit.
+	timeout time.Duration
+	// outputLimit is how many bytes the program may write to stdout
+	// and stderr together; 0 is no limit.
+	outputLimit int
+	// virtualTime runs the program on a virtual clock, and returns its
+	// output as events; see timeline.
+	virtualTime bool
+	// files are added to the file system of the run; see readFiles.
+	files js.M
+}
+
+func readRunOptions(o *js.Object) runOptions {
+	opts := runOptions{timeout: defaultTimeout, outputLimit: defaultOutputLimit, stdin: readInput(nil), files: readFiles(nil)}
+	if o == nil || o == js.Undefined {
+		return opts
+	}
+	opts.stdin = readInput(o.Get("stdin"))
+	opts.stdout = callback(o.Get("stdout"))
+	opts.stderr = callback(o.Get("stderr"))
+	opts.onOutput = callback(o.Get("onOutput"))
+	if t := o.Get("timeout"); t != js.Undefined && t != nil {
+		opts.timeout = time.Duration(t.Float() * float64(time.Millisecond))
+	}
+	if n := o.Get("outputLimit"); n != js.Undefined && n != nil {
+		opts.outputLimit = n.Int()
+	}
+	opts.virtualTime = o.Get("virtualTime").Bool()
+	opts.files = readFiles(o.Get("files"))
+	return opts
+}
+
+// callback returns the function f, an option, or nil if it is not set.
+func callback(f *js.Object) *js.Object {
+	if f == nil || f == js.Undefined {
+		return nil
+	}
+	return f
+}
+
+// exit is how a run ended.
+type exit struct {
+	status int
+	panic  js.M
+	limit  string // the limit that stopped the program, if any
+	err    error
+}
+
+// run runs code, a program written by the compiler, in a new Web Worker,
+// which has no access to the page, and returns {status, panic, limit,
+// elapsed, stdout, stderr} when it exits. status is that passed to
+// os.Exit, 0 if main returns, or 2 if the program panics, in which case
+// panic is {message, stack}, or deadlocks. A program that runs past the
+// timeout or writes more than the output limit is terminated, with
+// status -1 and limit set to "timeout" or "output"; stdout and stderr
+// then hold the output up to the limit. elapsed is in milliseconds.
+// Output is passed to the stdout, stderr and onOutput functions as it is
+// written; all of it has been when run returns. With virtual time, the
+// result also has the output as events. Unless the program is
+// terminated, the result has files, the files it left, {path:
+// Uint8Array}. If canceled is closed, the program is terminated and run
+// returns errCanceled.
+func (o runOptions) run(code string, canceled <-chan struct{}) (js.M, error) {
+	worker := js.Global.Get("Worker")
+	if worker == js.Undefined {
+		return nil, fmt.Errorf("cannot run program: Web Workers are not available")
+	}
+	// The call is the last statement written; the same text may occur
+	// earlier, in a string literal of the program.
+	i := strings.LastIndex(code, mainCall)
+	if i < 0 {
+		return nil, fmt.Errorf("cannot run program: %s not found", mainCall)
+	}
+	code = code[:i] + "goStart(function() { $go(goRunMain($mainPkg.$init), []); });" + code[i+len(mainCall):]
+	start := js.M{"type": "start", "stdin": o.stdin.data, "files": o.files}
+	if o.stdin.interactive() {
+		shared, err := o.stdin.shared()
+		if err != nil {
+			return nil, err
+		}
+		start["shared"] = shared
+	}
+	blob := js.Global.Get("Blob").New([]string{fsPrelude, runPrelude, code}, js.M{"type": "application/javascript"})
+	url := js.Global.Get("URL").Call("createObjectURL", blob)
+	defer js.Global.Get("URL").Call("revokeObjectURL", url)
+
+	var events *timeline
+	if o.virtualTime {
+		start["virtualTime"] = millis(epoch)
+		events = &timeline{now: millis(epoch), last: millis(epoch)}
+	}
+	streams := map[int]*stream{
+		1: newStream("stdout", o.stdout, o.onOutput, events),
+		2: newStream("stderr", o.stderr, o.onOutput, events),
+	}
+	written := 0
+	var files *js.Object
+	finished := false
+	done := make(chan exit, 1)
+	finish := func(e exit) {
+		if !finished {
+			finished = true
+			done <- e
+		}
+	}
+	began := time.Now()
+	w := worker.New(url)
+	defer w.Call("terminate")
+	w.Set("onmessage", func(e *js.Object) {
+		if finished {
+			return
+		}
+		data := e.Get("data")
+		switch data.Get("type").String() {
+		case "output":
+			s, ok := streams[data.Get("fd").Int()]
+			if !ok {
+				return
+			}
+			if events != nil {
+				events.at(data.Get("time").Float())
+			}
+			chunk := data.Get("data")
+			n := chunk.Length()
+			if o.outputLimit > 0 && written+n > o.outputLimit {
+				s.write(chunk.Call("subarray", 0, o.outputLimit-written))
+				written = o.outputLimit
+				finish(exit{status: -1, limit: limitOutput})
+				return
+			}
+			written += n
+			s.write(chunk)
+		case "read":
+			go o.stdin.supply(start["shared"].(*js.Object))
+		case "files":
+			files = data.Get("files")
+		case "exit":
+			finish(exit{status: data.Get("status").Int()})
+		case "panic":
+			message := data.Get("message").String()
+			streams[2].write(js.Global.Get("TextEncoder").New().Call("encode", "panic: "+message+"\n"))
+			finish(exit{status: 2, panic: js.M{"message": message, "stack": data.Get("stack").String()}})
+		}
+	})
+	w.Set("onerror", func(e *js.Object) {
+		e.Call("preventDefault")
+		finish(exit{err: fmt.Errorf("cannot run program: %s", e.Get("message"))})
+	})
+	w.Call("postMessage", start)
+	var timeout <-chan time.Time
+	if o.timeout > 0 {
+		timer := time.NewTimer(o.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var x exit
+	select {
+	case x = <-done:
+	case <-timeout:
+		finished = true
+		x = exit{status: -1, limit: limitTimeout}
+	case <-canceled:
+		finished = true
+		x = exit{err: errCanceled}
+	}
+	elapsed := time.Since(began)
+	if x.err != nil {
+		return nil, x.err
+	}
+	result := js.M{
+		"status":  x.status,
+		"panic":   nil,
+		"limit":   nil,
+		"elapsed": elapsed.Seconds() * 1000,
+	}
+	if x.panic != nil {
+		result["panic"] = x.panic
+	}
+	if x.limit != "" {
+		result["limit"] = x.limit
+	}
+	for _, fd := range []int{1, 2} {
+		s := streams[fd]
+		s.flush()
+		result[s.name] = s.text.String()
+	}
+	if events != nil {
+		result["events"] = events.objects()
+	}
+	if files != nil {
+		result["files"] = files
+	}
+	return result, nil
+}
+
+// stream collects the output of a run to stdout or stderr, passing the
+// bytes written to sink and the text to onOutput and events, if not nil.
+type stream struct {
+	name     string
+	sink     *js.Object
+	onOutput *js.Object
+	events   *timeline
+	decoder  *js.Object
+	text     bytes.Buffer
+}
+
+func newStream(name string, sink, onOutput *js.Object, events *timeline) *stream {
+	return &stream{
+		name:     name,
+		sink:     sink,
+		onOutput: onOutput,
+		events:   events,
+		decoder:  js.Global.Get("TextDecoder").New(),
+	}
+}
+
+// write adds chunk, a Uint8Array, which may end within a UTF-8 sequence.
+func (s *stream) write(chunk *js.Object) {
+	if s.sink != nil {
+		s.sink.Invoke(chunk)
+	}
+	s.add(s.decoder.Call("decode", chunk, js.M{"stream": true}).String())
+}
+
+// flush adds the text of what remains of a UTF-8 sequence left
+// incomplete.
+func (s *stream) flush() {
+	s.add(s.decoder.Call("decode").String())
+}
+
+func (s *stream) add(text string) {
+	if text == "" {
+		return
+	}
+	s.text.WriteString(text)
+	if s.events != nil {
+		s.events.add(s.name, text)
+	}
+	if s.onOutput != nil {
+		s.onOutput.Invoke(s.name, text)
+	}
+}
+
+// event is output of a run on a virtual clock, as the Go playground
+// reports it: Delay is the virtual time since the previous event.
+type event struct {
+	Delay   time.Duration
+	Kind    string // "stdout" or "stderr"
+	Message string
+}
+
+// timeline collects the events of a run on a virtual clock. Output
+// written at the same time to the same stream is one event.
+type timeline struct {
+	now    float64 // virtual time of the output being added; see millis
+	last   float64 // of the last event, or the start
+	events []event
+}
+
+// at sets the virtual time of the output added next.
+func (t *timeline) at(now float64) {
+	t.now = now
+}
+
+func (t *timeline) add(kind, text string) {
+	delay := time.Duration((t.now - t.last) * float64(time.Millisecond))
+	if n := len(t.events); n > 0 && delay == 0 && t.events[n-1].Kind == kind {
+		t.events[n-1].Message += text
+		return
+	}
+	t.events = append(t.events, event{Delay: delay, Kind: kind, Message: text})
+	t.last = t.now
+}
+
+// objects converts the events to {delay, kind, message}, delay being in
+// nanoseconds.
+func (t *timeline) objects() []js.M {
+	objs := make([]js.M, len(t.events))
+	for i, e := range t.events {
+		objs[i] = js.M{"delay": int64(e.Delay), "kind": e.Kind, "message": e.Message}
+	}
+	return objs
+}
+
+// millis returns t in milliseconds since 1970, as Javascript has times.
+func millis(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Millisecond)
+}
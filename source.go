@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// PackageSource provides the files of the package directory: an archive
+// named path + ".a" for each precompiled package, and imports.json.
+type PackageSource interface {
+	// ReadFile returns the contents of the file name. A file that does
+	// not exist is an error satisfying os.IsNotExist.
+	ReadFile(name string) ([]byte, error)
+}
+
+// forgetter is implemented by sources that keep copies of files.
+type forgetter interface {
+	// forget drops the copy of the file name, or all copies if name
+	// is "".
+	forget(name string)
+}
+
+// httpSource reads files below a base URI.
+type httpSource struct {
+	base string
+}
+
+func (s httpSource) ReadFile(name string) ([]byte, error) {
+	return get(s.base + name)
+}
+
+// memorySource holds files in memory, for embedding and tests.
+type memorySource map[string][]byte
+
+func (s memorySource) ReadFile(name string) ([]byte, error) {
+	b, ok := s[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return b, nil
+}
+
+// mirrorSource reads from the first of its sources that does not fail.
+// If all fail, the error is the first source's.
+type mirrorSource []PackageSource
+
+func (s mirrorSource) ReadFile(name string) ([]byte, error) {
+	var first error
+	for _, source := range s {
+		b, err := source.ReadFile(name)
+		if err == nil {
+			return b, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	if first == nil {
+		first = &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return nil, first
+}
+
+func (s mirrorSource) forget(name string) {
+	for _, source := range s {
+		if f, ok := source.(forgetter); ok {
+			f.forget(name)
+		}
+	}
+}
+
+// retries are the delays before reading a file again after a transient
+// failure.
+var retries = []time.Duration{250 * time.Millisecond, time.Second, 4 * time.Second}
+
+func readFile(source PackageSource, name string) (b []byte, err error) {
+	for i := 0; ; i++ {
+		b, err = source.ReadFile(name)
+		if err == nil || !transient(err) || i == len(retries) {
+			return
+		}
+		time.Sleep(retries[i])
+	}
+}
+
+// transient reports whether reading a file that failed with err may
+// succeed if tried again.
+func transient(err error) bool {
+	if os.IsNotExist(err) || corrupt(err) {
+		return false
+	}
+	if e, ok := err.(*statusError); ok {
+		return e.temporary()
+	}
+	return true
+}
+
+func get(uri string) ([]byte, error) {
+	res, err := http.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone {
+		return nil, &os.PathError{Op: "get", Path: uri, Err: os.ErrNotExist}
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, &statusError{uri: uri, status: res.Status, code: res.StatusCode}
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// statusError is an unsuccessful HTTP response other than not found.
+type statusError struct {
+	uri    string
+	status string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return "get " + e.uri + ": " + e.status
+}
+
+func (e *statusError) temporary() bool {
+	return e.code >= 500 || e.code == http.StatusRequestTimeout || e.code == http.StatusTooManyRequests
+}
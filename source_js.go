@@ -0,0 +1,66 @@
+// +build js
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// bytesOf returns the contents of an ArrayBuffer or typed array.
+func bytesOf(o *js.Object) []byte {
+	return js.Global.Get("Uint8Array").New(o).Interface().([]byte)
+}
+
+// newPackageSource returns the PackageSource described by spec:
+//
+//	{type: "http", uri}
+//	{type: "memory", files: {name: ArrayBuffer or Uint8Array, ...}}
+//	{type: "bundle", uri} or {type: "bundle", data: ArrayBuffer or Uint8Array}
+//	{type: "cache", name, source: spec, versioned}
+//	{type: "mirrors", sources: [spec, ...]}
+func newPackageSource(spec *js.Object) (PackageSource, error) {
+	if spec == nil || spec == js.Undefined {
+		return nil, fmt.Errorf("missing package source")
+	}
+	switch t := spec.Get("type").String(); t {
+	case "http":
+		return httpSource{base: spec.Get("uri").String()}, nil
+	case "memory":
+		files := spec.Get("files")
+		s := make(memorySource)
+		for _, name := range js.Keys(files) {
+			s[name] = bytesOf(files.Get(name))
+		}
+		return s, nil
+	case "bundle":
+		if data := spec.Get("data"); data != js.Undefined {
+			return &bundleSource{uri: "bundle", data: bytesOf(data)}, nil
+		}
+		return &bundleSource{uri: spec.Get("uri").String()}, nil
+	case "cache":
+		source, err := newPackageSource(spec.Get("source"))
+		if err != nil {
+			return nil, err
+		}
+		name := "jsplayground"
+		if n := spec.Get("name"); n != js.Undefined {
+			name = n.String()
+		}
+		return &cacheSource{name: name, source: source, versioned: spec.Get("versioned").Bool()}, nil
+	case "mirrors":
+		specs := spec.Get("sources")
+		var s mirrorSource
+		for i := 0; i < specs.Length(); i++ {
+			source, err := newPackageSource(specs.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, source)
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown package source type %q", t)
+	}
+}
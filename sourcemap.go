@@ -0,0 +1,87 @@
+// +build js
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"go/token"
+	"strings"
+
+	"github.com/neelance/sourcemap"
+)
+
+// programFile is the name the compiled program has in source maps.
+const programFile = "prog.js"
+
+// sourceMapper collects the mappings of a compiled program.
+type sourceMapper struct {
+	m       *sourcemap.Map
+	sources map[string][]byte
+}
+
+func newSourceMapper(sources map[string][]byte) *sourceMapper {
+	return &sourceMapper{
+		m:       &sourcemap.Map{File: programFile},
+		sources: sources,
+	}
+}
+
+// mapping is a compiler.SourceMapFilter MappingCallback.
+func (s *sourceMapper) mapping(generatedLine, generatedColumn int, originalPos token.Position) {
+	if !originalPos.IsValid() {
+		s.m.AddMapping(&sourcemap.Mapping{GeneratedLine: generatedLine, GeneratedColumn: generatedColumn})
+		return
+	}
+	s.m.AddMapping(&sourcemap.Mapping{
+		GeneratedLine:   generatedLine,
+		GeneratedColumn: generatedColumn,
+		OriginalFile:    s.file(originalPos.Filename),
+		OriginalLine:    originalPos.Line,
+		OriginalColumn:  originalPos.Column,
+	})
+}
+
+// file shortens the names of files that are not the user's to their
+// path below the GOROOT or GOPATH src directory they were compiled from.
+func (s *sourceMapper) file(name string) string {
+	if _, ok := s.sources[name]; ok {
+		return name
+	}
+	if i := strings.LastIndex(name, "/src/"); i != -1 {
+		return name[i+len("/src/"):]
+	}
+	return name
+}
+
+// encode returns the Source Map v3 document with the user's sources
+// embedded as sourcesContent.
+func (s *sourceMapper) encode() (string, error) {
+	buf := new(bytes.Buffer)
+	if err := s.m.WriteTo(buf); err != nil {
+		return "", err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		return "", err
+	}
+	names, _ := doc["sources"].([]interface{})
+	content := make([]interface{}, len(names))
+	for i, name := range names {
+		if src, ok := s.sources[name.(string)]; ok {
+			content[i] = string(src)
+		}
+	}
+	doc["sourcesContent"] = content
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// inline returns the comment that attaches sourceMap to the program.
+func inline(sourceMap string) string {
+	return "\n//# sourceMappingURL=data:application/json;base64," + base64.StdEncoding.EncodeToString([]byte(sourceMap)) + "\n"
+}
@@ -0,0 +1,117 @@
+// +build js
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// stdinSize is the most bytes of interactive input passed to a running
+// program at a time.
+const stdinSize = 64 << 10
+
+// input is the standard input of a run: either data, given up front, or
+// chunks read from next as the program reads.
+type input struct {
+	data *js.Object // a Uint8Array
+	// next returns the next chunk of input, a Uint8Array, or nil at the
+	// end of the input.
+	next func() (*js.Object, error)
+	rest *js.Object // of the last chunk, not yet passed to the program
+}
+
+// readInput returns the input o, which is a string, ArrayBuffer or
+// Uint8Array holding all of it, or a ReadableStream or function
+// producing it. The function is called as the program reads, and
+// returns a string or bytes, or a Promise of one, or null at the end.
+// Without o, the input is empty.
+func readInput(o *js.Object) *input {
+	if o == nil || o == js.Undefined {
+		return &input{data: js.Global.Get("Uint8Array").New(0)}
+	}
+	if o.Get("getReader") != js.Undefined {
+		reader := o.Call("getReader")
+		return &input{next: func() (*js.Object, error) {
+			result, err := await(reader.Call("read"))
+			if err != nil || result.Get("done").Bool() {
+				return nil, err
+			}
+			return chunk(result.Get("value")), nil
+		}}
+	}
+	switch o.Interface().(type) {
+	case string:
+		return &input{data: chunk(o)}
+	case func(...interface{}) *js.Object:
+		return &input{next: func() (*js.Object, error) {
+			value, err := await(js.Global.Get("Promise").Call("resolve", o.Invoke()))
+			if err != nil || value == nil || value == js.Undefined {
+				return nil, err
+			}
+			return chunk(value), nil
+		}}
+	}
+	return &input{data: chunk(o)}
+}
+
+// chunk returns the string or bytes o as a Uint8Array.
+func chunk(o *js.Object) *js.Object {
+	if _, ok := o.Interface().(string); ok {
+		return js.Global.Get("TextEncoder").New().Call("encode", o)
+	}
+	return js.Global.Get("Uint8Array").New(o)
+}
+
+// interactive reports whether the program is to wait for input as it
+// reads. Such input is passed to the worker in a SharedArrayBuffer,
+// which the page can only create if it is cross-origin isolated.
+func (in *input) interactive() bool {
+	return in.next != nil
+}
+
+// shared returns the SharedArrayBuffer interactive input is passed in.
+// It begins with two int32s: the state, set to 1 by supply when it has
+// written to the buffer and to 0 by the worker when it has read it, and
+// the number of bytes that follow, or -1 at the end of the input, or -2
+// if reading the input failed.
+func (in *input) shared() (*js.Object, error) {
+	sab := js.Global.Get("SharedArrayBuffer")
+	if isolated := js.Global.Get("crossOriginIsolated"); sab == js.Undefined || isolated != js.Undefined && !isolated.Bool() {
+		return nil, fmt.Errorf("cannot read input as the program runs: the page is not cross-origin isolated")
+	}
+	return sab.New(8 + stdinSize), nil
+}
+
+// supply writes the next chunk of input to shared for the worker, which
+// is waiting for it.
+func (in *input) supply(shared *js.Object) {
+	state := js.Global.Get("Int32Array").New(shared, 0, 2)
+	buf := js.Global.Get("Uint8Array").New(shared, 8)
+	b, err := in.rest, error(nil)
+	in.rest = nil
+	if b == nil {
+		b, err = in.next()
+	}
+	// An empty chunk would read as the end of the input.
+	for err == nil && b != nil && b.Length() == 0 {
+		b, err = in.next()
+	}
+	n := -1
+	switch {
+	case err != nil:
+		n = -2
+	case b != nil:
+		n = b.Length()
+		if n > stdinSize {
+			in.rest = b.Call("subarray", stdinSize)
+			b, n = b.Call("subarray", 0, stdinSize), stdinSize
+		}
+		buf.Call("set", b)
+	}
+	atomics := js.Global.Get("Atomics")
+	atomics.Call("store", state, 1, n)
+	atomics.Call("store", state, 0, 1)
+	atomics.Call("notify", state, 0)
+}
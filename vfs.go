@@ -0,0 +1,460 @@
+// +build js
+
+package main
+
+import (
+	"strings"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// fsPrelude is run in the worker before runPrelude. It defines goFS, the
+// in-memory file system of the run, which implements the file system
+// calls of linux/amd64 that package os makes. Files are passed to the
+// worker in the start message as {path: Uint8Array}, a path ending in a
+// slash being a directory, and read back with goFS.files. The file
+// system has /tmp, which is the working directory.
+const fsPrelude = `var goFS = (function() {
+  var S_IFMT = 0xf000, S_IFDIR = 0x4000, S_IFREG = 0x8000, S_IFCHR = 0x2000;
+  var ENOENT = 2, EBADF = 9, EEXIST = 17, ENOTDIR = 20, EISDIR = 21, EINVAL = 22, ERANGE = 34, ENOSYS = 38, ENOTEMPTY = 39;
+  var AT_FDCWD = -100, AT_REMOVEDIR = 0x200;
+  var O_ACCMODE = 3, O_CREAT = 0x40, O_EXCL = 0x80, O_TRUNC = 0x200, O_APPEND = 0x400, O_DIRECTORY = 0x10000;
+  var DT_DIR = 4, DT_REG = 8;
+  var encoder = new TextEncoder(), decoder = new TextDecoder();
+  var lastIno = 0;
+  var newNode = function(mode) {
+    return {
+      ino: ++lastIno,
+      mode: mode,
+      data: new Uint8Array(0),
+      size: 0,
+      entries: (mode & S_IFMT) === S_IFDIR ? Object.create(null) : null,
+      mtime: Date.now()
+    };
+  };
+  var root = newNode(S_IFDIR | 0x1ed);
+  var cwd = [];
+  var fds = {};
+  var nextFD = 3;
+
+  /* str returns the string of the NUL terminated bytes b. */
+  var str = function(b) {
+    var n = b.indexOf(0);
+    return decoder.decode(n < 0 ? b : b.subarray(0, n));
+  };
+  /* split returns the names in the path p, relative to the directory
+     of dirfd unless p is absolute. */
+  var split = function(dirfd, p) {
+    var base = cwd;
+    if (p.charAt(0) === "/") {
+      base = [];
+    } else if (dirfd !== undefined && (dirfd | 0) !== AT_FDCWD) {
+      var f = fds[dirfd];
+      if (f === undefined) {
+        throw EBADF;
+      }
+      base = f.names;
+    }
+    var names = base.slice();
+    p.split("/").forEach(function(s) {
+      if (s === "" || s === ".") {
+        return;
+      }
+      if (s === "..") {
+        names.pop();
+        return;
+      }
+      names.push(s);
+    });
+    return names;
+  };
+  /* lookup returns the directory holding the last of names, the name
+     and its node, which is undefined if there is none. */
+  var lookup = function(names) {
+    if (names.length === 0) {
+      return {dir: root, name: "", node: root};
+    }
+    var dir = root;
+    for (var i = 0; i < names.length - 1; i++) {
+      var next = dir.entries[names[i]];
+      if (next === undefined) {
+        throw ENOENT;
+      }
+      if (next.entries === null) {
+        throw ENOTDIR;
+      }
+      dir = next;
+    }
+    var name = names[names.length - 1];
+    return {dir: dir, name: name, node: dir.entries[name]};
+  };
+  var existing = function(dirfd, p) {
+    var l = lookup(split(dirfd, p));
+    if (l.node === undefined) {
+      throw ENOENT;
+    }
+    return l;
+  };
+  var file = function(fd) {
+    var f = fds[fd];
+    if (f === undefined) {
+      throw EBADF;
+    }
+    return f;
+  };
+  var grow = function(n, size) {
+    if (size > n.data.length) {
+      var data = new Uint8Array(Math.max(size, 2 * n.data.length));
+      data.set(n.data.subarray(0, n.size));
+      n.data = data;
+    }
+    if (size > n.size) {
+      n.size = size;
+    }
+  };
+  var truncate = function(n, size) {
+    if (n.entries !== null) {
+      throw EISDIR;
+    }
+    if (size < n.size) {
+      n.data.fill(0, size, n.size);
+      n.size = size;
+    } else {
+      grow(n, size);
+    }
+    n.mtime = Date.now();
+  };
+  var read = function(n, b, count, offset) {
+    if (n.entries !== null) {
+      throw EISDIR;
+    }
+    var k = Math.max(0, Math.min(count, n.size - offset));
+    b.set(n.data.subarray(offset, offset + k));
+    return k;
+  };
+  var write = function(n, b, count, offset) {
+    grow(n, offset + count);
+    n.data.set(b.subarray(0, count), offset);
+    n.mtime = Date.now();
+    return count;
+  };
+  var open = function(dirfd, p, flags, mode) {
+    var names = split(dirfd, p);
+    var l = lookup(names);
+    var n = l.node;
+    if (n === undefined) {
+      if ((flags & O_CREAT) === 0) {
+        throw ENOENT;
+      }
+      n = l.dir.entries[l.name] = newNode(S_IFREG | (mode & 0x1ff));
+    } else if ((flags & O_CREAT) !== 0 && (flags & O_EXCL) !== 0) {
+      throw EEXIST;
+    }
+    if (n.entries !== null && (flags & O_ACCMODE) !== 0) {
+      throw EISDIR;
+    }
+    if (n.entries === null && (flags & O_DIRECTORY) !== 0) {
+      throw ENOTDIR;
+    }
+    if (n.entries === null && (flags & O_TRUNC) !== 0 && (flags & O_ACCMODE) !== 0) {
+      truncate(n, 0);
+    }
+    var fd = nextFD++;
+    fds[fd] = {node: n, names: names, offset: 0, flags: flags, dirents: null};
+    return fd;
+  };
+  var mkdir = function(dirfd, p, mode) {
+    var l = lookup(split(dirfd, p));
+    if (l.node !== undefined) {
+      throw EEXIST;
+    }
+    l.dir.entries[l.name] = newNode(S_IFDIR | (mode & 0x1ff));
+    l.dir.mtime = Date.now();
+    return 0;
+  };
+  var unlink = function(dirfd, p, flags) {
+    var l = existing(dirfd, p);
+    if ((flags & AT_REMOVEDIR) !== 0) {
+      if (l.node.entries === null) {
+        throw ENOTDIR;
+      }
+      if (Object.keys(l.node.entries).length > 0) {
+        throw ENOTEMPTY;
+      }
+      if (l.node === root) {
+        throw EINVAL;
+      }
+    } else if (l.node.entries !== null) {
+      throw EISDIR;
+    }
+    delete l.dir.entries[l.name];
+    l.dir.mtime = Date.now();
+    return 0;
+  };
+  var rename = function(olddirfd, oldpath, newdirfd, newpath) {
+    var from = existing(olddirfd, oldpath);
+    var to = lookup(split(newdirfd, newpath));
+    if (to.node !== undefined && to.node !== from.node) {
+      if (to.node.entries !== null) {
+        if (from.node.entries === null) {
+          throw EISDIR;
+        }
+        if (Object.keys(to.node.entries).length > 0) {
+          throw ENOTEMPTY;
+        }
+      } else if (from.node.entries !== null) {
+        throw ENOTDIR;
+      }
+    }
+    delete from.dir.entries[from.name];
+    to.dir.entries[to.name] = from.node;
+    from.dir.mtime = to.dir.mtime = Date.now();
+    return 0;
+  };
+  /* stat writes n to st, a Stat_t of 144 bytes laid out as GopherJS
+     lays it out: that of linux/amd64, little endian. */
+  var stat = function(n, st) {
+    var v = new DataView(st.buffer, st.byteOffset, st.byteLength);
+    var u64 = function(offset, x) {
+      v.setUint32(offset, x % 4294967296, true);
+      v.setUint32(offset + 4, Math.floor(x / 4294967296), true);
+    };
+    var timespec = function(offset, ms) {
+      u64(offset, Math.floor(ms / 1000));
+      u64(offset + 8, (ms % 1000) * 1000000);
+    };
+    u64(0, 1);
+    u64(8, n.ino);
+    u64(16, n.entries !== null ? 2 : 1);
+    v.setUint32(24, n.mode, true);
+    u64(48, n.entries !== null ? 4096 : n.size);
+    u64(56, 4096);
+    u64(64, Math.ceil(n.size / 512));
+    timespec(72, n.mtime);
+    timespec(88, n.mtime);
+    timespec(104, n.mtime);
+    return 0;
+  };
+  var tty = newNode(S_IFCHR | 0x190);
+  var fstat = function(fd, st) {
+    return stat(fd <= 2 ? tty : file(fd).node, st);
+  };
+  /* getdents writes the entries of the directory fd, as linux_dirent64,
+     to b, continuing from the last call. */
+  var getdents = function(fd, b, count) {
+    var f = file(fd);
+    if (f.node.entries === null) {
+      throw ENOTDIR;
+    }
+    if (f.dirents === null) {
+      f.dirents = Object.keys(f.node.entries).sort();
+    }
+    var v = new DataView(b.buffer, b.byteOffset, count);
+    var n = 0;
+    while (f.dirents.length > 0) {
+      var name = encoder.encode(f.dirents[0]);
+      var reclen = (19 + name.length + 1 + 7) & ~7;
+      if (n + reclen > count) {
+        if (n === 0) {
+          throw EINVAL;
+        }
+        break;
+      }
+      var e = f.node.entries[f.dirents.shift()];
+      if (e === undefined) {
+        continue;
+      }
+      b.fill(0, n, n + reclen);
+      v.setUint32(n, e.ino, true);
+      v.setUint32(n + 8, n + reclen, true);
+      v.setUint16(n + 16, reclen, true);
+      v.setUint8(n + 18, e.entries !== null ? DT_DIR : DT_REG);
+      b.set(name, n + 19);
+      n += reclen;
+    }
+    return n;
+  };
+  var getcwd = function(b, size) {
+    var p = encoder.encode("/" + cwd.join("/"));
+    if (p.length + 1 > size) {
+      throw ERANGE;
+    }
+    b.set(p);
+    b[p.length] = 0;
+    return p.length + 1;
+  };
+  var chdir = function(p) {
+    var names = split(undefined, p);
+    var l = lookup(names);
+    if (l.node === undefined) {
+      throw ENOENT;
+    }
+    if (l.node.entries === null) {
+      throw ENOTDIR;
+    }
+    cwd = names;
+    return 0;
+  };
+  var chmod = function(n, mode) {
+    n.mode = (n.mode & S_IFMT) | (mode & 0xfff);
+    return 0;
+  };
+  var seek = function(fd, offset, whence) {
+    var f = file(fd);
+    offset = offset | 0;
+    switch (whence) {
+    case 0:
+      break;
+    case 1:
+      offset += f.offset;
+      break;
+    case 2:
+      offset += f.node.size;
+      break;
+    default:
+      throw EINVAL;
+    }
+    if (offset < 0) {
+      throw EINVAL;
+    }
+    f.offset = offset;
+    return offset;
+  };
+
+  /* calls maps system call numbers to their implementations. */
+  var calls = {
+    0: function(fd, b, count) { /* read */
+      var f = file(fd);
+      var k = read(f.node, b, count, f.offset);
+      f.offset += k;
+      return k;
+    },
+    1: function(fd, b, count) { /* write */
+      var f = file(fd);
+      if ((f.flags & O_APPEND) !== 0) {
+        f.offset = f.node.size;
+      }
+      f.offset += write(f.node, b, count, f.offset);
+      return count;
+    },
+    2: function(p, flags, mode) { return open(undefined, str(p), flags, mode); }, /* open */
+    3: function(fd) { /* close */
+      if (fd > 2) {
+        file(fd);
+        delete fds[fd];
+      }
+      return 0;
+    },
+    4: function(p, st) { return stat(existing(undefined, str(p)).node, st); }, /* stat */
+    5: fstat,
+    6: function(p, st) { return stat(existing(undefined, str(p)).node, st); }, /* lstat */
+    8: seek, /* lseek */
+    17: function(fd, b, count, offset) { return read(file(fd).node, b, count, offset); }, /* pread64 */
+    18: function(fd, b, count, offset) { return write(file(fd).node, b, count, offset); }, /* pwrite64 */
+    21: function(p) { existing(undefined, str(p)); return 0; }, /* access */
+    72: function() { return 0; }, /* fcntl */
+    74: function(fd) { file(fd); return 0; }, /* fsync */
+    75: function(fd) { file(fd); return 0; }, /* fdatasync */
+    76: function(p, size) { truncate(existing(undefined, str(p)).node, size); return 0; }, /* truncate */
+    77: function(fd, size) { truncate(file(fd).node, size); return 0; }, /* ftruncate */
+    79: getcwd,
+    80: function(p) { return chdir(str(p)); }, /* chdir */
+    82: function(oldpath, newpath) { return rename(undefined, str(oldpath), undefined, str(newpath)); }, /* rename */
+    83: function(p, mode) { return mkdir(undefined, str(p), mode); }, /* mkdir */
+    84: function(p) { return unlink(undefined, str(p), AT_REMOVEDIR); }, /* rmdir */
+    87: function(p) { return unlink(undefined, str(p), 0); }, /* unlink */
+    89: function() { throw EINVAL; }, /* readlink */
+    90: function(p, mode) { return chmod(existing(undefined, str(p)).node, mode); }, /* chmod */
+    91: function(fd, mode) { return chmod(file(fd).node, mode); }, /* fchmod */
+    217: getdents, /* getdents64 */
+    257: function(dirfd, p, flags, mode) { return open(dirfd, str(p), flags, mode); }, /* openat */
+    258: function(dirfd, p, mode) { return mkdir(dirfd, str(p), mode); }, /* mkdirat */
+    262: function(dirfd, p, st) { return stat(existing(dirfd, str(p)).node, st); }, /* newfstatat */
+    263: function(dirfd, p, flags) { return unlink(dirfd, str(p), flags); }, /* unlinkat */
+    264: function(olddirfd, oldpath, newdirfd, newpath) { return rename(olddirfd, str(oldpath), newdirfd, str(newpath)); }, /* renameat */
+    267: function() { throw EINVAL; }, /* readlinkat */
+    268: function(dirfd, p, mode) { return chmod(existing(dirfd, str(p)).node, mode); }, /* fchmodat */
+    269: function(dirfd, p) { existing(dirfd, str(p)); return 0; }, /* faccessat */
+    280: function() { return 0; }, /* utimensat */
+    316: function(olddirfd, oldpath, newdirfd, newpath) { return rename(olddirfd, str(oldpath), newdirfd, str(newpath)); } /* renameat2 */
+  };
+
+  var mkdirAll = function(names) {
+    var dir = root;
+    names.forEach(function(name) {
+      if (dir.entries[name] === undefined) {
+        dir.entries[name] = newNode(S_IFDIR | 0x1ed);
+      }
+      dir = dir.entries[name];
+    });
+    return dir;
+  };
+  mkdirAll(["tmp"]);
+  cwd = ["tmp"];
+
+  return {
+    /* syscall makes the system call trap, returning [r1, r2, errno]. */
+    syscall: function(trap, a1, a2, a3, a4, a5, a6) {
+      var call = calls[trap];
+      if (call === undefined) {
+        return [-1, 0, ENOSYS];
+      }
+      try {
+        return [call(a1, a2, a3, a4, a5, a6), 0, 0];
+      } catch (e) {
+        if (typeof e === "number") {
+          return [-1, 0, e];
+        }
+        throw e;
+      }
+    },
+    /* add adds files, {path: Uint8Array}; paths ending in a slash are
+       directories. Relative paths are relative to the working directory. */
+    add: function(files) {
+      Object.keys(files).forEach(function(p) {
+        var names = split(undefined, p);
+        if (p.charAt(p.length - 1) === "/") {
+          mkdirAll(names);
+          return;
+        }
+        var dir = mkdirAll(names.slice(0, -1));
+        var n = dir.entries[names[names.length - 1]] = newNode(S_IFREG | 0x1a4);
+        write(n, files[p], files[p].length, 0);
+      });
+    },
+    /* files returns the regular files, {path: Uint8Array}. */
+    files: function() {
+      var files = {};
+      var walk = function(dir, p) {
+        Object.keys(dir.entries).sort().forEach(function(name) {
+          var n = dir.entries[name];
+          if (n.entries !== null) {
+            walk(n, p + name + "/");
+          } else if ((n.mode & S_IFMT) === S_IFREG) {
+            files[p + name] = n.data.slice(0, n.size);
+          }
+        });
+      };
+      walk(root, "/");
+      return files;
+    }
+  };
+})();
+`
+
+// readFiles returns the files o, {path: contents}, for the start message
+// of a run, the contents being strings or bytes.
+func readFiles(o *js.Object) js.M {
+	files := js.M{}
+	if o == nil || o == js.Undefined {
+		return files
+	}
+	for _, name := range js.Keys(o) {
+		if strings.HasSuffix(name, "/") {
+			files[name] = nil
+			continue
+		}
+		files[name] = chunk(o.Get(name))
+	}
+	return files
+}
@@ -0,0 +1,203 @@
+// +build js
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// protocolVersion is the value of the jsplayground field that marks the
+// messages of the worker protocol; see client.js.
+const protocolVersion = 1
+
+// server answers the requests posted to the Web Worker the program runs
+// in. A request is
+//
+//	{jsplayground: 1, id, method, args, callbacks}
+//
+// where method names a method of Go in lower camel case, or fixImports,
+// which is format with imports, or cancel, which takes the id of a
+// request. Options and arguments that are functions in the Go API are
+// sent as true and named in callbacks, the function arguments of
+// Preload and OnProgress as onProgress; calls to them are posted as
+//
+//	{jsplayground: 1, id, event, args}
+//
+// where event is the name of the option, such as onOutput. Each request
+// is answered once, with
+//
+//	{jsplayground: 1, id, result} or {jsplayground: 1, id, error}
+//
+// where error is what the promise of the method rejects with, or the
+// message of the error it throws.
+type server struct {
+	g        *Go
+	pending  map[int]bool       // requests not yet answered
+	promises map[int]*js.Object // of the pending requests, if any
+}
+
+// serveWorker makes g answer requests if the program runs in a Web
+// Worker. Go is still installed for scripts the worker imports.
+func serveWorker(g *Go) {
+	if js.Global.Get("WorkerGlobalScope") == js.Undefined {
+		return
+	}
+	s := &server{g: g, pending: make(map[int]bool), promises: make(map[int]*js.Object)}
+	js.Global.Call("addEventListener", "message", func(e *js.Object) {
+		data := e.Get("data")
+		if data == nil || data == js.Undefined || data.Get("jsplayground") == js.Undefined {
+			return
+		}
+		s.handle(data)
+	})
+}
+
+func (s *server) post(id int, m js.M) {
+	m["jsplayground"] = protocolVersion
+	m["id"] = id
+	js.Global.Call("postMessage", m)
+}
+
+// answer posts the result or error of request id, unless it has been
+// answered.
+func (s *server) answer(id int, m js.M) {
+	if !s.pending[id] {
+		return
+	}
+	delete(s.pending, id)
+	delete(s.promises, id)
+	s.post(id, m)
+}
+
+// settle answers request id when p settles.
+func (s *server) settle(id int, p *js.Object) {
+	s.promises[id] = p
+	p.Call("then", func(result *js.Object) {
+		s.answer(id, js.M{"result": result})
+	}, func(reason *js.Object) {
+		s.answer(id, js.M{"error": reason})
+	})
+}
+
+// events replaces the options of o, an options object of request id,
+// named in callbacks with functions posting their calls. Other options,
+// true or not, are left as they are.
+func (s *server) events(id int, o *js.Object, callbacks map[string]bool) *js.Object {
+	if o == nil || o == js.Undefined {
+		return o
+	}
+	for _, key := range js.Keys(o) {
+		if callbacks[key] {
+			o.Set(key, s.event(id, key))
+		}
+	}
+	return o
+}
+
+// event returns a function posting its calls as event of request id.
+func (s *server) event(id int, event string) *js.Object {
+	return js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		s.post(id, js.M{"event": event, "args": args})
+		return nil
+	})
+}
+
+func (s *server) handle(m *js.Object) {
+	id := m.Get("id").Int()
+	method := m.Get("method").String()
+	args := m.Get("args")
+	arg := func(i int) *js.Object {
+		if args == js.Undefined || args == nil || i >= args.Length() {
+			return js.Undefined
+		}
+		return args.Index(i)
+	}
+	callbacks := make(map[string]bool)
+	if c := m.Get("callbacks"); c != nil && c != js.Undefined {
+		for i := 0; i < c.Length(); i++ {
+			callbacks[c.Index(i).String()] = true
+		}
+	}
+	s.pending[id] = true
+	defer func() {
+		if e := recover(); e != nil {
+			if err, ok := e.(*js.Error); ok {
+				s.answer(id, js.M{"error": err.Get("message").String()})
+				return
+			}
+			s.answer(id, js.M{"error": fmt.Sprint(e)})
+		}
+	}()
+	switch method {
+	case "compile":
+		s.settle(id, s.g.Compile(arg(0).String(), s.events(id, arg(1), callbacks)))
+	case "compileFiles":
+		s.settle(id, s.g.CompileFiles(stringMap(arg(0)), s.events(id, arg(1), callbacks)))
+	case "run":
+		s.settle(id, s.g.Run(arg(0).String(), s.events(id, arg(1), callbacks)))
+	case "format":
+		s.settle(id, s.g.Format(arg(0).String(), arg(1).Bool(), nil))
+	case "fixImports":
+		s.settle(id, s.g.Format(arg(0).String(), true, nil))
+	case "preload":
+		var paths []string
+		for i := 0; i < arg(0).Length(); i++ {
+			paths = append(paths, arg(0).Index(i).String())
+		}
+		var onProgress *js.Object
+		if callbacks["onProgress"] {
+			onProgress = s.event(id, "onProgress")
+		}
+		s.settle(id, s.g.Preload(paths, onProgress))
+	case "onProgress":
+		var f *js.Object
+		if callbacks["onProgress"] {
+			f = s.event(id, "onProgress")
+		}
+		s.g.OnProgress(f)
+		s.answer(id, js.M{"result": nil})
+	case "clearCache":
+		s.settle(id, s.g.ClearCache(arg(0)))
+	case "packageURI":
+		var uris []*js.Object
+		for i := 0; args != js.Undefined && i < args.Length(); i++ {
+			uris = append(uris, args.Index(i))
+		}
+		s.g.PackageURI(uris...)
+		s.answer(id, js.M{"result": nil})
+	case "packageSource":
+		s.g.PackageSource(arg(0))
+		s.answer(id, js.M{"result": nil})
+	case "moduleProxy":
+		s.g.ModuleProxy(arg(0))
+		s.answer(id, js.M{"result": nil})
+	case "cancel":
+		s.answer(id, js.M{"result": nil})
+		s.cancel(arg(0).Int())
+	default:
+		s.answer(id, js.M{"error": fmt.Sprintf("unknown method %q", method)})
+	}
+}
+
+// cancel cancels request id, if it can be, and answers it with a
+// cancellation. Its result, if it completes anyway, is dropped.
+func (s *server) cancel(id int) {
+	if p := s.promises[id]; p != nil && p.Get("cancel") != js.Undefined {
+		p.Call("cancel")
+	}
+	s.answer(id, js.M{"error": objects([]diagnostic{canceled()})})
+}
+
+// stringMap returns the string properties of o.
+func stringMap(o *js.Object) map[string]string {
+	m := make(map[string]string)
+	if o == nil || o == js.Undefined {
+		return m
+	}
+	for _, key := range js.Keys(o) {
+		m[key] = o.Get(key).String()
+	}
+	return m
+}
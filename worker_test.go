@@ -0,0 +1,27 @@
+// +build js
+
+package main
+
+import (
+	"testing"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+func TestEvents(t *testing.T) {
+	s := &server{pending: make(map[int]bool), promises: make(map[int]*js.Object)}
+	o := js.Global.Get("Object").New()
+	o.Set("sourceMap", true)
+	o.Set("virtualTime", true)
+	o.Set("onOutput", true)
+	o = s.events(1, o, map[string]bool{"onOutput": true})
+	if opts := readOptions(o); !opts.sourceMap || opts.inline {
+		t.Errorf("sourceMap: true read as %+v", opts)
+	}
+	if _, ok := o.Get("virtualTime").Interface().(bool); !ok {
+		t.Error("virtualTime: true is not a boolean")
+	}
+	if _, ok := o.Get("onOutput").Interface().(bool); ok {
+		t.Error("onOutput, a callback, is not a function")
+	}
+}